@@ -0,0 +1,450 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isGzipArchive reports whether the archive is compressed, by its extension like "backup.tar.gz" or "backup.tgz"
+func isGzipArchive(archivePath string) bool {
+	return strings.HasSuffix(archivePath, ".gz") || strings.HasSuffix(archivePath, ".tgz")
+}
+
+// runArchive writes every file selected from the projects into a fresh tar archive, instead of mirroring them into the backup dir.
+// The archive replaces the previous one atomically once it's complete, so there's nothing to compare or remove.
+func (run *backupRun) runArchive(runStart time.Time) (Report, error) {
+	var err error
+
+	run.config.GitBinary, err = exec.LookPath(run.config.GitBinary)
+	if err != nil {
+		return Report{}, err
+	}
+
+	projects, skippedProjects, err := run.findProjects()
+	if err != nil {
+		return Report{}, err
+	}
+
+	for _, skippedProject := range skippedProjects {
+		run.logVerbose("x", skippedProject.name, "(project skipped)")
+	}
+
+	report := run.newReport(projects)
+
+	projectErrors := make(map[string][]error)
+
+	reportProjectError := func(projectName string, err error) {
+		run.logError(fmt.Sprintf("%s: %v", projectName, err))
+		projectErrors[projectName] = append(projectErrors[projectName], err)
+
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", projectName, err))
+		report.Projects[projectName].Errors = append(report.Projects[projectName].Errors, err.Error())
+	}
+
+	projectScans := run.scanArchivedProjects(projects)
+
+	if run.config.DryRun {
+		run.logInfo("Simulating the archive:")
+		run.logInfo()
+	}
+
+	// The archive is streamed into writeFile, which reads it until the pipe is closed.
+	// A dry run only lists the files, so nothing is read or written.
+	archiveReader, archiveWriter := io.Pipe()
+	archiveDone := make(chan error, 1)
+
+	var tarWriter *tar.Writer
+	var gzipWriter *gzip.Writer
+
+	if run.config.DryRun {
+		archiveDone <- nil
+	} else {
+		go func() {
+			_, err := run.writeFile(run.config.Archive, archiveReader, nil)
+			archiveReader.CloseWithError(err)
+			archiveDone <- err
+		}()
+
+		var output io.Writer = archiveWriter
+		if isGzipArchive(run.config.Archive) {
+			gzipWriter = gzip.NewWriter(archiveWriter)
+			output = gzipWriter
+		}
+
+		tarWriter = tar.NewWriter(output)
+	}
+
+	sinceTime := time.Now().Add(-run.config.Since)
+
+	err = func() error {
+		for i, scan := range projectScans {
+			// A partial archive would replace the previous complete one, so it's discarded instead
+			if run.config.FailFast && len(report.Errors) > 0 {
+				return errArchiveStopped
+			}
+			// Closing the stop channel, like on an interrupt, discards the archive being written the same way as "--fail-fast"
+			if run.isInterrupted() {
+				return errArchiveInterrupted
+			}
+
+			projectName := projects[i].name
+			projectReport := report.Projects[projectName]
+
+			if scan.err != nil {
+				reportProjectError(projectName, scan.err)
+				continue
+			}
+
+			for _, excludedRelPath := range scan.excludedRelPaths {
+				run.logVerbose("x", excludedRelPath, "(excluded)")
+			}
+
+			for _, file := range scan.files {
+				if run.isInterrupted() {
+					return errArchiveInterrupted
+				}
+
+				// The archive has no filesystem restrictions, so the original names are kept
+				relPath := file.relPath
+				if file.sourceRelPath != "" {
+					relPath = file.sourceRelPath
+				}
+
+				size, err := run.archiveFile(tarWriter, file, relPath, runStart, sinceTime)
+				if errors.Is(err, errArchiveSkipped) {
+					report.FilesSkipped++
+					continue
+				}
+
+				// A failure after the header is written leaves a broken entry, so only the failures before it are per file
+				var fileErr archiveFileError
+				if errors.As(err, &fileErr) {
+					reportProjectError(projectName, fileErr.err)
+
+					if run.config.FailFast {
+						return errArchiveStopped
+					}
+
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				if size < 0 {
+					continue
+				}
+
+				report.FilesCopied++
+				report.BytesCopied += size
+				projectReport.FilesCopied++
+				projectReport.BytesCopied += size
+				projectReport.FilesBackedUp++
+				projectReport.BytesBackedUp += size
+
+				if run.config.DryRun {
+					run.logInfo("+", relPath)
+				} else {
+					run.logVerbose("+", relPath)
+				}
+
+				run.emitEvent(Event{Type: EventFileCopied, Project: projectName, Path: relPath})
+			}
+
+			run.emitEvent(Event{Type: EventProjectDone, Project: projectName, Path: projects[i].path})
+		}
+
+		if tarWriter == nil {
+			return nil
+		}
+
+		if err := tarWriter.Close(); err != nil {
+			return err
+		}
+
+		if gzipWriter != nil {
+			return gzipWriter.Close()
+		}
+
+		return nil
+	}()
+
+	archiveWriter.CloseWithError(err)
+	if archiveErr := <-archiveDone; err == nil {
+		err = archiveErr
+	}
+	if errors.Is(err, errArchiveStopped) || errors.Is(err, errArchiveInterrupted) {
+		warning := fmt.Sprintf("Stopped after the first error, %s is left as is", run.config.Archive)
+		if errors.Is(err, errArchiveInterrupted) {
+			warning = fmt.Sprintf("Interrupted, %s is left as is", run.config.Archive)
+		}
+
+		run.logWarning(warning)
+		report.Warnings = append(report.Warnings, warning)
+		report.Truncated = true
+	} else if err != nil {
+		return Report{}, fmt.Errorf("failed to write the archive %s: %w", run.config.Archive, err)
+	}
+
+	report.ProjectsFailed = len(projectErrors)
+
+	report.Duration = time.Since(runStart)
+	run.emitEvent(Event{Type: EventRunComplete, Report: report})
+
+	return *report, nil
+}
+
+// errArchiveStopped discards the archive being written after the first error with "--fail-fast"
+var errArchiveStopped = errors.New("stopped after an error")
+
+// errArchiveInterrupted discards the archive being written once the stop channel is closed
+var errArchiveInterrupted = errors.New("interrupted")
+
+// errArchiveSkipped is returned by [archiveFile] for a file left out of the archive by the filters
+var errArchiveSkipped = errors.New("skipped")
+
+// archiveFileError is a failure of a single file before anything of it is written to the archive
+type archiveFileError struct {
+	err error
+}
+
+func (e archiveFileError) Error() string {
+	return e.err.Error()
+}
+
+// archiveFile writes a single file into the archive under the relative path and returns its size.
+// The size is negative if the file is gone, like a deleted file in the git change list.
+// Without an archive writer, as in a dry run, the file is only checked against the filters.
+func (run *backupRun) archiveFile(tarWriter *tar.Writer, file backupFile, relPath string, runStart, sinceTime time.Time) (int64, error) {
+	if file.content != nil && tarWriter == nil {
+		return int64(len(file.content)), nil
+	}
+
+	if file.content != nil {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(relPath),
+			Mode:     0644,
+			Size:     int64(len(file.content)),
+			ModTime:  runStart,
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return 0, err
+		}
+
+		_, err := tarWriter.Write(file.content)
+
+		return header.Size, err
+	}
+
+	info, err := os.Lstat(file.path)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, archiveFileError{err}
+	}
+
+	// Submodules appear in the git change list as directories. Their files are listed via "--include-submodules".
+	if info.IsDir() {
+		return -1, nil
+	}
+
+	if isReparsePoint(info) {
+		run.logWarning(fmt.Sprintf("Skipping %s, it's a junction or another reparse point", relPath))
+		return 0, errArchiveSkipped
+	}
+
+	if run.config.Since > 0 && info.ModTime().Before(sinceTime) {
+		run.logVerbose("x", relPath, "(not modified within", run.config.Since.String()+")")
+		return 0, errArchiveSkipped
+	}
+
+	if run.config.MaxFileSize > 0 && info.Size() > run.config.MaxFileSize {
+		run.logWarning(fmt.Sprintf("Skipping %s (%s), it's larger than the max file size", relPath, FormatSize(info.Size())))
+		return 0, errArchiveSkipped
+	}
+
+	if tarWriter == nil {
+		return info.Size(), nil
+	}
+
+	linkTarget := ""
+	if isSymlink(info) {
+		linkTarget, err = os.Readlink(file.path)
+		if err != nil {
+			return 0, archiveFileError{err}
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return 0, archiveFileError{err}
+	}
+	header.Name = filepath.ToSlash(relPath)
+
+	// The owner names are only meaningful on the machine the archive is written on
+	header.Uname, header.Gname = "", ""
+
+	if isSymlink(info) {
+		return 0, tarWriter.WriteHeader(header)
+	}
+
+	sourceFile, err := os.Open(longPath(file.path))
+	if err != nil {
+		return 0, archiveFileError{err}
+	}
+	defer sourceFile.Close()
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return 0, err
+	}
+
+	// A file growing while being archived is cut at the size in its header, as the entry can't be resized
+	_, err = copyBuffered(tarWriter, io.LimitReader(sourceFile, header.Size))
+
+	return header.Size, err
+}
+
+// scanArchivedProjects lists the files of the projects concurrently, keeping the project order
+func (run *backupRun) scanArchivedProjects(projects []project) []projectScan {
+	projectScans := make([]projectScan, len(projects))
+
+	scanQueue := make(chan int)
+
+	var scanners sync.WaitGroup
+	for range run.config.Jobs {
+		scanners.Add(1)
+
+		go func() {
+			defer scanners.Done()
+
+			for index := range scanQueue {
+				run.emitEvent(Event{Type: EventScanStart, Project: projects[index].name, Path: projects[index].path})
+
+				scanStart := time.Now()
+				projectScans[index] = run.scanProject(projects[index])
+				projectScans[index].duration = time.Since(scanStart)
+			}
+		}()
+	}
+
+	for index := range projects {
+		scanQueue <- index
+	}
+	close(scanQueue)
+
+	scanners.Wait()
+
+	return projectScans
+}
+
+// restoreArchive extracts every file of the archive back into its project.
+// Files that already exist in the projects are left untouched unless forced.
+func (run *backupRun) restoreArchive() (RestoreReport, error) {
+	archiveFile, err := os.Open(run.config.Archive)
+	if err != nil {
+		return RestoreReport{}, err
+	}
+	defer archiveFile.Close()
+
+	var input io.Reader = archiveFile
+	if isGzipArchive(run.config.Archive) {
+		gzipReader, err := gzip.NewReader(archiveFile)
+		if err != nil {
+			return RestoreReport{}, err
+		}
+		defer gzipReader.Close()
+
+		input = gzipReader
+	}
+
+	report := RestoreReport{Errors: []string{}}
+
+	tarReader := tar.NewReader(input)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if run.isInterrupted() {
+			report.Truncated = true
+			break
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+
+		entryRelPath := filepath.FromSlash(header.Name)
+
+		// A crafted entry like "../../.bashrc" must not be written outside the projects
+		if !filepath.IsLocal(entryRelPath) {
+			err := fmt.Errorf("refusing to restore %s outside the projects", header.Name)
+			run.logError(err)
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		// Exported git state like stash patches has to be applied manually
+		if slices.Contains(strings.Split(entryRelPath, string(filepath.Separator)), metadataDirName) {
+			continue
+		}
+
+		projectFilePath, err := run.findRestorePath(entryRelPath)
+		if err != nil {
+			run.logError(err)
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		if !run.config.Force {
+			if _, err := os.Lstat(projectFilePath); !os.IsNotExist(err) {
+				run.logVerbose("=", entryRelPath, "(already exists)")
+				report.FilesSkipped++
+				continue
+			}
+		}
+
+		if run.config.DryRun {
+			run.logInfo("+", entryRelPath)
+			report.FilesRestored++
+			continue
+		}
+
+		if header.Typeflag == tar.TypeSymlink {
+			err = os.MkdirAll(filepath.Dir(projectFilePath), 0755)
+			if err == nil {
+				err = writeSymlink(header.Linkname, longPath(projectFilePath))
+			}
+		} else {
+			_, err = run.writeFile(projectFilePath, tarReader, header.FileInfo())
+		}
+
+		if err != nil {
+			run.logError(err)
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		report.FilesRestored++
+		run.logVerbose("+", entryRelPath, "(restored)")
+	}
+
+	return report, nil
+}
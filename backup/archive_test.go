@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArchiveInterruptedKeepsPreviousArchive(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+
+	cfg := testConfig(projectsDirPath, "")
+	cfg.Archive = filepath.Join(filepath.Dir(backupDirPath), "backup.tar")
+	runBackup(t, cfg)
+
+	previousArchive := readTestFile(t, cfg.Archive)
+
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "changed notes")
+
+	stop := make(chan struct{})
+	close(stop)
+	cfg.Stop = stop
+
+	report := runBackup(t, cfg)
+
+	if !report.Truncated || !slices.ContainsFunc(report.Warnings, func(warning string) bool { return strings.HasPrefix(warning, "Interrupted") }) {
+		t.Errorf("report is truncated %t with warnings %q, want it interrupted", report.Truncated, report.Warnings)
+	}
+	if readTestFile(t, cfg.Archive) != previousArchive {
+		t.Error("archive is replaced by a partial one")
+	}
+}
+
+func TestRestoreArchiveRejectsWritingThroughSymlink(t *testing.T) {
+	projectsDirPath, _ := newTestDirs(t)
+	outsideDirPath := t.TempDir()
+
+	// A crafted archive links a dir of the project outside, then writes a file through the link
+	archivePath := filepath.Join(t.TempDir(), "hostile.tar")
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tarWriter := tar.NewWriter(archiveFile)
+	entries := []struct {
+		header  tar.Header
+		content string
+	}{
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "app/link", Linkname: outsideDirPath}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "app/link/escaped.txt", Mode: 0644, Size: 7}, "escaped"},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "app/notes.txt", Mode: 0644, Size: 5}, "notes"},
+	}
+	for _, entry := range entries {
+		if err := tarWriter.WriteHeader(&entry.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := archiveFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(projectsDirPath, "")
+	cfg.Archive = archivePath
+
+	report, err := Restore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "through the symlink") {
+		t.Errorf("restore errors are %q, want one about writing through the symlink", report.Errors)
+	}
+	if _, err := os.Lstat(filepath.Join(outsideDirPath, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("escaped.txt is written outside the project (%v)", err)
+	}
+	if got := readTestFile(t, filepath.Join(projectsDirPath, "app", "notes.txt")); got != "notes" {
+		t.Errorf("notes.txt is restored with %q, want %q", got, "notes")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package backup
+
+import (
+	"io/fs"
+	"time"
+)
+
+// accessTime falls back to the modification time on platforms where the access time isn't exposed
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
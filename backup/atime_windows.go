@@ -0,0 +1,16 @@
+package backup
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time of a file
+func accessTime(info fs.FileInfo) time.Time {
+	if attributes, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, attributes.LastAccessTime.Nanoseconds())
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,2423 @@
+package backup
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Run backs up the local changes of every git project in the projects dirs into the backup dir.
+// Failures of a single project or file don't stop the run, they are collected in the report instead.
+// The error is only returned when the run can't start or can't read the backup dir.
+func Run(cfg Config) (Report, error) {
+	runStart := time.Now()
+
+	// Past the time budget, no new project is scanned and no new file is copied. The unfinished ones are left for the next run.
+	isOverBudget := func() bool {
+		return cfg.TimeBudget > 0 && time.Since(runStart) > cfg.TimeBudget
+	}
+
+	// With "--fail-fast", the first error stops the run the same way. The workers flag it as soon as it happens.
+	var hasFailed atomic.Bool
+	isFailedFast := func() bool {
+		return cfg.FailFast && hasFailed.Load()
+	}
+
+	// Closing the stop channel, like on an interrupt, stops the run the same way, so that the completed copies are recorded
+	isInterrupted := func() bool {
+		select {
+		case <-cfg.Stop:
+			return true
+		default:
+			return false
+		}
+	}
+
+	isStopped := func() bool {
+		return isOverBudget() || isFailedFast() || isInterrupted()
+	}
+
+	stopReason := func() string {
+		if isInterrupted() {
+			return "(interrupted)"
+		}
+		if isFailedFast() {
+			return "(stopped after an error)"
+		}
+
+		return "(time budget exceeded)"
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Report{}, err
+	}
+
+	run := newBackupRun(cfg)
+
+	if run.config.Archive != "" {
+		return run.runArchive(runStart)
+	}
+
+	// A fresh setup starts with an empty backup dir, which a dry run only pretends to create
+	backupDirExists := true
+	if _, err := os.Stat(run.config.BackupDir); os.IsNotExist(err) {
+		if run.config.RequireBackupDir {
+			return Report{}, fmt.Errorf("backup directory %s doesn't exist", run.config.BackupDir)
+		} else if run.config.DryRun {
+			backupDirExists = false
+		} else if err := os.MkdirAll(run.config.BackupDir, 0755); err != nil {
+			return Report{}, err
+		} else {
+			run.logInfo("Created the backup directory", run.config.BackupDir)
+		}
+	}
+
+	// Two runs writing the same backup directory would corrupt it. A dry run doesn't write anything, so it doesn't lock.
+	var err error
+	lockPath := ""
+	if !run.config.DryRun {
+		lockPath, err = run.acquireLock(run.config.BackupDir)
+		if err != nil {
+			return Report{}, err
+		}
+	}
+	defer run.releaseLock(lockPath)
+
+	// Paths differing only by case are the same file on a case-insensitive backup filesystem
+	isCaseInsensitive := run.config.CaseInsensitiveTarget
+	if !isCaseInsensitive && backupDirExists {
+		isCaseInsensitive, err = run.isCaseInsensitiveDir(run.config.BackupDir)
+		if err != nil {
+			return Report{}, err
+		}
+	}
+
+	foldCase := func(relPath string) string {
+		if isCaseInsensitive {
+			return strings.ToLower(relPath)
+		}
+
+		return relPath
+	}
+
+	// Check if git is installed. The resolved path is used for every git command, so a changing PATH doesn't matter.
+	run.config.GitBinary, err = exec.LookPath(run.config.GitBinary)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if run.config.TrashDir != "" && !run.config.DryRun {
+		if err := cleanTrash(run.config.TrashDir, run.config.TrashRetention); err != nil {
+			run.logWarning("Failed to clean up the trash:", err)
+		}
+	}
+
+	//#region Read the full backup directory
+
+	backedUpFileRelPaths, backedUpDirRelPaths, err := run.walkBackupDir()
+
+	// The missing backup dir of a dry run is the same as an empty one
+	if err != nil && backupDirExists {
+		return Report{}, err
+	}
+	if err != nil {
+		backedUpFileRelPaths, backedUpDirRelPaths = map[string]struct{}{}, []string{}
+	}
+
+	run.backupManifest, run.backupProjectStates, err = readManifest(filepath.Join(run.config.BackupDir, manifestFileName))
+	if err != nil {
+		return Report{}, err
+	}
+
+	// The files copied by an interrupted run are up to date unless their source changed since, like the ones in the manifest
+	journalPath := filepath.Join(run.config.BackupDir, journalFileName)
+	if err := readJournal(journalPath, run.backupManifest); err != nil {
+		return Report{}, err
+	}
+
+	//#endregion Read the full backup directory
+
+	//#region Visit each project directory and make a list of files to backup
+
+	projects, skippedProjects, err := run.findProjects()
+	if err != nil {
+		return Report{}, err
+	}
+
+	for _, skippedProject := range skippedProjects {
+		run.logVerbose("x", skippedProject.name, "(project skipped)")
+	}
+
+	report := run.newReport(projects)
+
+	// Per-project failures are collected here instead of aborting the whole run
+	projectErrors := make(map[string][]error)
+
+	reportProjectError := func(projectName string, err error) {
+		run.logError(fmt.Sprintf("%s: %v", projectName, err))
+		projectErrors[projectName] = append(projectErrors[projectName], err)
+		hasFailed.Store(true)
+
+		report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", projectName, err))
+		report.Projects[projectName].Errors = append(report.Projects[projectName].Errors, err.Error())
+	}
+
+	scanQueue := make(chan int)
+	scanResults := make(chan projectScan)
+
+	var scanners sync.WaitGroup
+	for range run.config.Jobs {
+		scanners.Add(1)
+
+		go func() {
+			defer scanners.Done()
+
+			for index := range scanQueue {
+				run.emitEvent(Event{Type: EventScanStart, Project: projects[index].name, Path: projects[index].path})
+
+				scanStart := time.Now()
+
+				var scan projectScan
+				if isStopped() {
+					scan.isTruncated = true
+				} else if state, ok := run.backupProjectStates[projects[index].name]; ok && run.config.NewerThanBackup && !run.config.Check &&
+					!hasChangesSince(projects[index].path, time.Unix(0, state.BackedUpAt)) {
+					scan.isUnchanged = true
+				} else {
+					scan = run.scanProject(projects[index])
+				}
+
+				if scan.err != nil {
+					hasFailed.Store(true)
+				}
+
+				scan.index = index
+				scan.startedAt = scanStart
+				scan.duration = time.Since(scanStart)
+
+				scanResults <- scan
+			}
+		}()
+	}
+
+	go func() {
+		for index := range projects {
+			scanQueue <- index
+		}
+		close(scanQueue)
+
+		scanners.Wait()
+		close(scanResults)
+	}()
+
+	// Scans finish in any order, so they are put back in the project order for a deterministic output
+	projectScans := make([]projectScan, len(projects))
+	for scan := range scanResults {
+		projectScans[scan.index] = scan
+	}
+
+	projectFiles := []backupFile{}
+	emptyDirRelPaths := []string{}
+	truncatedProjectsCount := 0
+
+	// Backup paths by their case-folded form, to catch the files that would overwrite each other
+	foldedRelPaths := make(map[string]string)
+	collidingFiles := []backupFile{}
+
+	for i, scan := range projectScans {
+		report.Projects[projects[i].name].ScanDuration = scan.duration
+
+		if scan.err != nil {
+			reportProjectError(projects[i].name, scan.err)
+			continue
+		}
+
+		if scan.isUnchanged {
+			run.logVerbose("=", projects[i].name, "(project unchanged since the last backup)")
+			continue
+		}
+
+		if scan.isTruncated {
+			run.logVerbose("x", projects[i].name, stopReason())
+			truncatedProjectsCount++
+			continue
+		}
+
+		for _, excludedRelPath := range scan.excludedRelPaths {
+			run.logVerbose("x", excludedRelPath, "(excluded)")
+		}
+
+		emptyDirRelPaths = append(emptyDirRelPaths, scan.emptyDirRelPaths...)
+
+		for _, file := range scan.files {
+			if existingRelPath, ok := foldedRelPaths[foldCase(file.relPath)]; ok && existingRelPath != file.relPath {
+				collidingFiles = append(collidingFiles, file)
+				continue
+			}
+
+			foldedRelPaths[foldCase(file.relPath)] = file.relPath
+			projectFiles = append(projectFiles, file)
+		}
+	}
+
+	// The existing backup of a project that failed to be scanned or was skipped is kept as is,
+	// instead of being removed as stale
+	keptProjectNames := []string{}
+	for projectName := range projectErrors {
+		keptProjectNames = append(keptProjectNames, projectName)
+	}
+	for _, skippedProject := range skippedProjects {
+		keptProjectNames = append(keptProjectNames, skippedProject.name)
+	}
+	for i, scan := range projectScans {
+		if scan.isUnchanged || scan.isTruncated {
+			keptProjectNames = append(keptProjectNames, projects[i].name)
+		}
+	}
+
+	// isInKeptProject reports whether a backup path belongs to one of the kept projects.
+	// The flattened files of a project start with its flattened name, while its generated files are always in its dir.
+	isInKeptProject := func(backupRelPath string) bool {
+		return slices.ContainsFunc(keptProjectNames, func(projectName string) bool {
+			if run.config.SanitizeNames {
+				projectName = sanitizeRelPath(projectName)
+			}
+
+			prefixes := []string{projectName + string(filepath.Separator)}
+			if run.config.Flatten {
+				prefixes = append(prefixes, flattenRelPath(projectName)+flattenedPathSeparator)
+			}
+
+			return foldCase(backupRelPath) == foldCase(projectName) || slices.ContainsFunc(prefixes, func(prefix string) bool {
+				return strings.HasPrefix(foldCase(backupRelPath), foldCase(prefix))
+			})
+		})
+	}
+
+	for backupFileRelPath := range backedUpFileRelPaths {
+		if isInKeptProject(backupFileRelPath) {
+			delete(backedUpFileRelPaths, backupFileRelPath)
+		}
+	}
+
+	// Reported after the kept projects are settled, so that the rest of the project is still backed up as usual
+	for _, file := range collidingFiles {
+		reportProjectError(file.projectName, fmt.Errorf("%s and %s differ only by case, which the backup filesystem can't tell apart, skipping the latter",
+			foldedRelPaths[foldCase(file.relPath)], file.relPath))
+	}
+
+	//#endregion Visit each project directory and make a list of files to backup
+
+	if run.config.Check {
+		run.logInfo("Checking the backup directory:")
+		run.logInfo()
+	} else if run.config.DryRun {
+		run.logInfo("Simulating changes to backup directory:")
+		run.logInfo()
+	}
+
+	//#region Make the necessary changes to the backup directory
+
+	// The backed up paths may differ by case from the project paths on a case-insensitive backup filesystem
+	backedUpFoldedRelPaths := make(map[string]string)
+	if isCaseInsensitive {
+		for backupFileRelPath := range backedUpFileRelPaths {
+			backedUpFoldedRelPaths[foldCase(backupFileRelPath)] = backupFileRelPath
+		}
+	}
+
+	// takeBackedUpFile reports whether the file is already in the backup, and takes it off the files to remove
+	takeBackedUpFile := func(relPath string) bool {
+		_, isBackedUp := backedUpFileRelPaths[relPath]
+		if backedUpRelPath, ok := backedUpFoldedRelPaths[foldCase(relPath)]; ok && !isBackedUp {
+			relPath = backedUpRelPath
+			_, isBackedUp = backedUpFileRelPaths[relPath]
+		}
+
+		delete(backedUpFileRelPaths, relPath)
+
+		return isBackedUp
+	}
+
+	copyJobs := []copyJob{}
+	sinceTime := time.Now().Add(-run.config.Since)
+
+	for _, projectFile := range projectFiles {
+		if projectFile.content != nil {
+			isBackedUp := takeBackedUpFile(projectFile.relPath)
+
+			copyJobs = append(copyJobs, copyJob{
+				index:      len(copyJobs),
+				file:       projectFile,
+				isBackedUp: isBackedUp,
+				size:       int64(len(projectFile.content)),
+			})
+
+			continue
+		}
+
+		projectFilePath := projectFile.path
+
+		// Deleted files can appear in the git change list. Will be removed later.
+		// Lstat keeps dangling symlinks, as they are backed up as links.
+		projectFileInfo, err := os.Lstat(projectFilePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		// A file that can't be read, like one without permission, still exists, so its backup is kept under either name
+		if err != nil {
+			takeBackedUpFile(projectFile.relPath)
+			if run.config.Compress != "" {
+				takeBackedUpFile(projectFile.relPath + compressedFileExt)
+			}
+
+			reportProjectError(projectFile.projectName, err)
+			continue
+		}
+
+		// Submodules appear in the git change list as directories. Their files are listed via "--include-submodules".
+		if projectFileInfo.IsDir() {
+			continue
+		}
+
+		// A junction can point back into the project, so it's neither followed nor recreated
+		if isReparsePoint(projectFileInfo) {
+			run.logWarning(fmt.Sprintf("Skipping %s, it's a junction or another reparse point", projectFile.relPath))
+			report.FilesSkipped++
+			continue
+		}
+
+		// A file crossing the size threshold changes its backup name, so its backup under the other name is removed as stale
+		if run.shouldCompress(projectFile.relPath, projectFileInfo) {
+			projectFile.relPath += compressedFileExt
+		}
+
+		isBackedUp := takeBackedUpFile(projectFile.relPath)
+
+		job := copyJob{
+			index:      len(copyJobs),
+			file:       projectFile,
+			isBackedUp: isBackedUp,
+			size:       projectFileInfo.Size(),
+			modTime:    projectFileInfo.ModTime(),
+		}
+
+		// Older files are only left out of this run, so their existing backup is kept as is
+		if run.config.Since > 0 && projectFileInfo.ModTime().Before(sinceTime) {
+			if run.config.DryRun {
+				run.logInfo("x", projectFile.relPath, "(not modified within", run.config.Since.String()+")")
+			} else {
+				run.logVerbose("x", projectFile.relPath, "(not modified within", run.config.Since.String()+")")
+			}
+
+			report.FilesSkipped++
+			continue
+		}
+
+		// An existing backup of a file that grew too large is kept as is
+		if run.config.MaxFileSize > 0 && job.size > run.config.MaxFileSize {
+			run.logWarning(fmt.Sprintf("Skipping %s (%s), it's larger than the max file size", projectFile.relPath, FormatSize(job.size)))
+			report.FilesSkipped++
+			continue
+		}
+
+		copyJobs = append(copyJobs, job)
+	}
+
+	// The dropped files are left out like the ones over the max file size, so their existing backups are kept as is
+	if run.config.MaxTotalSize > 0 {
+		var droppedJobs []copyJob
+		copyJobs, droppedJobs = capTotalSize(copyJobs, run.config.MaxTotalSize)
+
+		droppedSize := int64(0)
+		for _, job := range droppedJobs {
+			if run.config.DryRun {
+				run.logInfo("x", job.file.relPath, "(over the max total size)")
+			} else {
+				run.logVerbose("x", job.file.relPath, "(over the max total size)")
+			}
+
+			droppedSize += job.size
+			report.FilesSkipped++
+		}
+
+		if len(droppedJobs) > 0 {
+			warning := fmt.Sprintf("%d files (%s) are left out to stay under the max total size of %s, the least recently modified first",
+				len(droppedJobs), FormatSize(droppedSize), FormatSize(run.config.MaxTotalSize))
+
+			run.logWarning(warning)
+			report.Warnings = append(report.Warnings, warning)
+		}
+	}
+
+	if run.config.Progress && !run.config.DryRun {
+		totalSize := int64(0)
+		for _, job := range copyJobs {
+			totalSize += job.size
+		}
+
+		run.copyProgress = startProgress(totalSize)
+	}
+
+	if run.config.RateLimit > 0 {
+		run.copyRateLimiter = newRateLimiter(run.config.RateLimit)
+	}
+
+	// Every completed copy is journaled right away, as the manifest is only written at the end of the run
+	var runJournal *journal
+	if !run.config.DryRun {
+		runJournal, err = openJournal(journalPath)
+		if err != nil {
+			return Report{}, err
+		}
+		defer runJournal.close()
+	}
+
+	jobQueue := make(chan copyJob)
+	jobResults := make(chan copyResult)
+
+	var workers sync.WaitGroup
+	for range run.config.Jobs {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for job := range jobQueue {
+				if isStopped() {
+					jobResults <- copyResult{index: job.index, isTruncated: true}
+					continue
+				}
+
+				result := run.runCopyJob(job)
+
+				// A file deleted after being listed is skipped like the deleted files in the git change list, and its backup is removed next run
+				if errors.Is(result.err, fs.ErrNotExist) && job.file.content == nil {
+					if _, err := os.Lstat(job.file.path); os.IsNotExist(err) {
+						result = copyResult{index: job.index, isDeleted: true}
+					}
+				}
+
+				if result.err != nil {
+					hasFailed.Store(true)
+				}
+
+				if result.manifestEntry != nil && runJournal != nil {
+					entry := *result.manifestEntry
+					entry.SourcePath = filepath.ToSlash(job.file.sourceRelPath)
+
+					// A failed record only costs hashing the file once more after an interrupt
+					if err := runJournal.record(job.file.relPath, entry); err != nil {
+						result.warning = fmt.Sprintf("Failed to journal %s: %v", job.file.relPath, err)
+					}
+				}
+
+				// Emitted from the worker instead of the ordered results below, so that the copies can be followed live
+				if result.err == nil && result.isChanged {
+					run.emitEvent(Event{Type: EventFileCopied, Project: job.file.projectName, Path: job.file.relPath})
+				}
+
+				jobResults <- result
+			}
+		}()
+	}
+
+	go func() {
+		for _, job := range copyJobs {
+			jobQueue <- job
+		}
+		close(jobQueue)
+
+		workers.Wait()
+		close(jobResults)
+	}()
+
+	// Results arrive in completion order, so they are put back in the job order for a deterministic output
+	copyResults := make([]copyResult, len(copyJobs))
+	for result := range jobResults {
+		copyResults[result.index] = result
+	}
+
+	if run.copyProgress != nil {
+		run.copyProgress.finish()
+	}
+
+	// Projects with files left for the next run
+	truncatedProjectNames := make(map[string]struct{})
+	truncatedFilesCount := 0
+
+	// Printed as a tree after the removals are known, instead of line by line
+	isTreeOutput := run.config.DryRun && run.config.OutputFormat == "tree"
+	plannedChanges := []plannedChange{}
+
+	for i, result := range copyResults {
+		job := copyJobs[i]
+
+		if result.isTruncated {
+			run.logVerbose("x", job.file.relPath, stopReason())
+			truncatedProjectNames[job.file.projectName] = struct{}{}
+			truncatedFilesCount++
+			report.FilesSkipped++
+			continue
+		}
+
+		if result.manifestEntry != nil {
+			// Renamed files are mapped back to their source paths while restoring
+			result.manifestEntry.SourcePath = filepath.ToSlash(job.file.sourceRelPath)
+
+			run.backupManifest[job.file.relPath] = *result.manifestEntry
+		} else if result.isChanged && !run.config.DryRun {
+			// The entry of the previous copy would describe the replaced content, which the objects and the checksums follow
+			delete(run.backupManifest, job.file.relPath)
+		}
+
+		if result.isDeleted {
+			run.logVerbose("x", job.file.relPath, "(deleted during the backup)")
+			report.FilesSkipped++
+			continue
+		}
+
+		if result.err != nil {
+			reportProjectError(job.file.projectName, result.err)
+			continue
+		}
+
+		if result.warning != "" {
+			run.logWarning(result.warning)
+			report.Warnings = append(report.Warnings, result.warning)
+		}
+
+		if result.isKept {
+			report.FilesSkipped++
+			continue
+		}
+
+		projectReport := report.Projects[job.file.projectName]
+		projectReport.FilesBackedUp++
+		projectReport.BytesBackedUp += job.size
+
+		if !result.isChanged {
+			run.logVerbose("=", job.file.relPath, "(unchanged)")
+			continue
+		}
+
+		if job.isBackedUp {
+			report.FilesUpdated++
+			projectReport.FilesUpdated++
+		} else {
+			report.FilesCopied++
+			projectReport.FilesCopied++
+		}
+
+		report.BytesCopied += job.size
+		projectReport.BytesCopied += job.size
+
+		if isTreeOutput {
+			marker := "+"
+			if job.isBackedUp {
+				marker = "~"
+			}
+
+			plannedChanges = append(plannedChanges, plannedChange{marker, job.file.relPath})
+		} else if run.config.Check {
+			reason := "(missing from the backup)"
+			if job.isBackedUp {
+				reason = "(differs from the backup)"
+			}
+
+			run.logInfo("+", job.file.relPath, reason)
+		} else if run.config.Verbose {
+			reason := "(new)"
+			if job.isBackedUp {
+				reason = "(changed)"
+			}
+			if result.changeReason != "" {
+				reason = "(changed, " + result.changeReason + ")"
+			}
+
+			run.logVerbose("+", job.file.relPath, reason)
+		} else if run.config.DryRun {
+			run.logInfo("+", job.file.relPath)
+		}
+
+		if run.config.DryRun && run.config.ShowDiffLines > 0 && !isTreeOutput && job.isBackedUp && job.file.content == nil {
+			run.printDiff(job.file.relPath, job.file.path)
+		}
+	}
+
+	for _, project := range projects {
+		event := Event{Type: EventProjectDone, Project: project.name, Path: project.path}
+		if errs := projectErrors[project.name]; len(errs) > 0 {
+			event.Error = errors.Join(errs...).Error()
+		}
+
+		run.emitEvent(event)
+	}
+
+	// An append-only backup keeps the files no longer in the projects along with their manifest entries,
+	// so they are compared as usual if they come back
+	if run.config.KeepRemovedFiles && len(backedUpFileRelPaths) > 0 {
+		run.logVerbose(fmt.Sprintf("Keeping %d files no longer in the projects", len(backedUpFileRelPaths)))
+		clear(backedUpFileRelPaths)
+	}
+
+	// A misdetected git state can make a whole project look removed, so the removals can be confirmed first
+	if run.config.ConfirmRemovals != nil && !run.config.DryRun && len(backedUpFileRelPaths) > 0 {
+		removedRelPaths := slices.Sorted(maps.Keys(backedUpFileRelPaths))
+
+		if !run.config.ConfirmRemovals(removedRelPaths) {
+			run.logInfo(fmt.Sprintf("Keeping %d files no longer in the projects", len(removedRelPaths)))
+			clear(backedUpFileRelPaths)
+		}
+	}
+
+	// Removed files are recorded before being deleted, so a bad run can be traced
+	var removalLog *os.File
+	if run.config.RemovalLog && !run.config.DryRun && len(backedUpFileRelPaths) > 0 {
+		removalLog, err = os.OpenFile(filepath.Join(run.config.BackupDir, removalLogFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			run.logError("Failed to open the removal log:", err)
+			report.Errors = append(report.Errors, err.Error())
+
+			// Nothing is deleted without a record of it
+			clear(backedUpFileRelPaths)
+		}
+	}
+
+	trashRunDirPath := ""
+	if run.config.TrashDir != "" {
+		trashRunDirPath = filepath.Join(run.config.TrashDir, time.Now().Format(trashTimeLayout))
+	}
+
+	// Removing files from backup folder that are no longer in the project
+	for backupFileRelPath := range backedUpFileRelPaths {
+		// Nothing more is removed after an error, including the ones of the earlier phases
+		if run.config.FailFast && len(report.Errors) > 0 || isInterrupted() {
+			break
+		}
+
+		if !run.config.DryRun {
+			backupFilePath, err := run.resolveBackupPath(backupFileRelPath)
+			if err != nil {
+				run.logError(err)
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+
+			if removalLog != nil {
+				_, err := fmt.Fprintf(removalLog, "%s\t%s\n", time.Now().Format(time.RFC3339), filepath.ToSlash(backupFileRelPath))
+				if err != nil {
+					run.logError("Failed to write the removal log:", err)
+					report.Errors = append(report.Errors, err.Error())
+					continue
+				}
+			}
+
+			if trashRunDirPath != "" {
+				err = run.moveToTrash(backupFileRelPath, trashRunDirPath)
+			} else {
+				err = os.Remove(backupFilePath)
+			}
+			if err != nil {
+				run.logError(err)
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+
+			delete(run.backupManifest, backupFileRelPath)
+		}
+
+		if isTreeOutput {
+			plannedChanges = append(plannedChanges, plannedChange{"-", backupFileRelPath})
+		} else if run.config.Verbose || run.config.Check {
+			run.logInfo("-", backupFileRelPath, "(no longer in the project)")
+		} else if run.config.DryRun {
+			run.logInfo("-", backupFileRelPath)
+		}
+
+		run.emitEvent(Event{Type: EventFileRemoved, Path: backupFileRelPath})
+
+		report.FilesRemoved++
+	}
+
+	if removalLog != nil {
+		removalLog.Close()
+	}
+
+	// Empty dirs are mirrored after the removals, so that a file replaced by a dir of the same name is gone by then
+	mirroredDirRelPaths := make(map[string]struct{}, len(emptyDirRelPaths))
+	for _, emptyDirRelPath := range emptyDirRelPaths {
+		mirroredDirRelPaths[emptyDirRelPath] = struct{}{}
+
+		emptyDirPath := filepath.Join(run.config.BackupDir, emptyDirRelPath)
+		if info, err := os.Stat(emptyDirPath); err == nil && info.IsDir() {
+			continue
+		}
+
+		if isTreeOutput {
+			plannedChanges = append(plannedChanges, plannedChange{"+", emptyDirRelPath + string(filepath.Separator)})
+		} else if run.config.Verbose || run.config.Check {
+			run.logInfo("+", emptyDirRelPath+string(filepath.Separator), "(empty dir)")
+		} else if run.config.DryRun {
+			run.logInfo("+", emptyDirRelPath+string(filepath.Separator))
+		}
+
+		if run.config.DryRun {
+			continue
+		}
+
+		if err := os.MkdirAll(longPath(emptyDirPath), 0755); err != nil {
+			run.logError(err)
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	if isTreeOutput {
+		run.printChangeTree(plannedChanges)
+	}
+
+	// Removing empty dirs recursively, the deepest first, so that a parent becomes empty after its children are removed.
+	// The backup dir itself is never removed.
+	if !run.config.DryRun && !run.config.KeepEmptyDirs && !run.config.KeepRemovedFiles {
+		slices.SortStableFunc(backedUpDirRelPaths, func(a, b string) int {
+			return cmp.Compare(strings.Count(b, string(filepath.Separator)), strings.Count(a, string(filepath.Separator)))
+		})
+
+		for _, backupDirRelPath := range backedUpDirRelPaths {
+			if backupDirRelPath == "." {
+				continue
+			}
+
+			if _, isMirrored := mirroredDirRelPaths[backupDirRelPath]; isMirrored {
+				continue
+			}
+
+			// The backup of a kept project is left as is, including the empty dirs mirrored by an earlier run
+			if isInKeptProject(backupDirRelPath) {
+				continue
+			}
+
+			backupDirPath, err := run.resolveBackupPath(backupDirRelPath)
+			if err != nil {
+				run.logError(err)
+				continue
+			}
+
+			// Only the dirs that became empty are removed. The error message of a non-empty dir differs by OS,
+			// so the entries are checked beforehand instead of relying on a failed removal.
+			entries, err := os.ReadDir(backupDirPath)
+			if err != nil || len(entries) > 0 {
+				continue
+			}
+
+			if err := os.Remove(backupDirPath); err != nil && !os.IsNotExist(err) {
+				run.logError(err)
+			}
+		}
+	}
+
+	// Only a project backed up without any errors is recorded, so that a failed file is retried on the next run.
+	// The states of the projects that no longer exist are dropped.
+	projectStates := make(projectStates)
+	for _, skippedProject := range skippedProjects {
+		if state, ok := run.backupProjectStates[skippedProject.name]; ok {
+			projectStates[skippedProject.name] = state
+		}
+	}
+	for i, scan := range projectScans {
+		_, isTruncated := truncatedProjectNames[projects[i].name]
+
+		if len(projectErrors[projects[i].name]) > 0 || scan.isUnchanged || scan.isTruncated || isTruncated {
+			if state, ok := run.backupProjectStates[projects[i].name]; ok {
+				projectStates[projects[i].name] = state
+			}
+
+			continue
+		}
+
+		projectStates[projects[i].name] = projectState{BackedUpAt: scan.startedAt.UnixNano()}
+	}
+
+	// The objects of the removed files are only removed after the run, as they may be shared with other files
+	if !run.config.DryRun {
+		if err := run.removeUnusedObjects(); err != nil {
+			run.logError("Failed to clean up the object store:", err)
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	if !run.config.DryRun {
+		if err := run.writeManifest(filepath.Join(run.config.BackupDir, manifestFileName), run.backupManifest, projectStates); err != nil {
+			run.logError("Failed to write the manifest:", err)
+			report.Errors = append(report.Errors, err.Error())
+		} else {
+			// The manifest has every journaled file now
+			runJournal.close()
+			if err := os.Remove(journalPath); err != nil {
+				run.logWarning(fmt.Sprintf("Failed to remove the journal: %v", err))
+			}
+		}
+	}
+
+	if run.config.Checksums && !run.config.DryRun {
+		if err := run.writeChecksums(filepath.Join(run.config.BackupDir, checksumsFileName), run.backupManifest); err != nil {
+			run.logError("Failed to write the checksums:", err)
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	//#endregion Make the necessary changes to the backup directory
+
+	if truncatedProjectsCount > 0 || truncatedFilesCount > 0 || isInterrupted() {
+		warning := fmt.Sprintf("Time budget of %s exceeded, %d projects and %d files are left for the next run",
+			run.config.TimeBudget, truncatedProjectsCount, truncatedFilesCount)
+		if isFailedFast() {
+			warning = fmt.Sprintf("Stopped after the first error, %d projects and %d files are left for the next run",
+				truncatedProjectsCount, truncatedFilesCount)
+		}
+		if isInterrupted() {
+			warning = fmt.Sprintf("Interrupted, %d projects and %d files are left for the next run",
+				truncatedProjectsCount, truncatedFilesCount)
+		}
+
+		run.logWarning(warning)
+		report.Warnings = append(report.Warnings, warning)
+		report.Truncated = true
+	}
+
+	report.ProjectsFailed = len(projectErrors)
+	report.Duration = time.Since(runStart)
+
+	run.emitEvent(Event{Type: EventRunComplete, Report: report})
+
+	return *report, nil
+}
+
+// removalLogFileName is the file in the backup root that records the removed files via "--removal-log"
+const removalLogFileName = ".git-backup-removed.log"
+
+// internalRelPaths are the files and dirs of the tool in the backup root, which aren't backed up project files
+var internalRelPaths = map[string]struct{}{
+	manifestFileName:   {},
+	lockFileName:       {},
+	removalLogFileName: {},
+	journalFileName:    {},
+	checksumsFileName:  {},
+	objectsDirName:     {}, // The objects are only reachable through the backed up files pointing to them
+}
+
+// isInternalPath reports whether a path inside the backup dir belongs to the tool rather than to a backed up project,
+// like the manifest or a trash dir inside the backup dir. These are never removed, pruned or restored as backed up files.
+func (run *backupRun) isInternalPath(path string) bool {
+	if run.config.TrashDir != "" && path == run.config.TrashDir {
+		return true
+	}
+
+	relPath, err := filepath.Rel(run.config.BackupDir, path)
+	if err != nil {
+		return false
+	}
+
+	_, isInternal := internalRelPaths[relPath]
+
+	return isInternal
+}
+
+// project is a git repository found in the projects dir
+type project struct {
+	name    string // Path of the project dir relative to the projects dir
+	path    string // Full path of the project dir
+	isPlain bool   // Whether it's a dir without git, backed up wholesale via "--plain-dir"
+}
+
+// findProjects lists the git projects of every projects dir along with the individually given projects.
+// Projects with the same name in different projects dirs would overwrite each other in the backup, so they are rejected.
+//
+// The projects matching "--exclude-project" or missing from "--project" are returned separately as skipped.
+func (run *backupRun) findProjects() (projects, skippedProjects []project, err error) {
+	foundProjects := []project{}
+
+	for _, projectsPath := range run.config.ProjectsDirs {
+		projectsInDir, err := run.findProjectsIn(projectsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		foundProjects = append(foundProjects, projectsInDir...)
+	}
+
+	// Projects scattered across the filesystem are backed up under their dir name
+	for _, projectPath := range run.config.ProjectPaths {
+		if !isGitProject(projectPath) {
+			return nil, nil, fmt.Errorf("%s isn't a git project", projectPath)
+		}
+
+		foundProjects = append(foundProjects, project{name: filepath.Base(projectPath), path: projectPath})
+	}
+
+	projectPaths := make(map[string]string)
+
+	unmatchedProjectNames := make(map[string]struct{})
+	for _, projectName := range run.config.Projects {
+		unmatchedProjectNames[filepath.Clean(projectName)] = struct{}{}
+	}
+
+	for _, project := range foundProjects {
+		_, isSelected := unmatchedProjectNames[project.name]
+		delete(unmatchedProjectNames, project.name)
+
+		if (len(run.config.Projects) > 0 && !isSelected) || matchAnyPattern(run.config.ExcludeProjects, project.name) {
+			skippedProjects = append(skippedProjects, project)
+			continue
+		}
+
+		// The projects are selected by their dir names, but backed up under the names of the layout
+		project.name = run.layoutName(project)
+
+		if existingPath, ok := projectPaths[project.name]; ok {
+			return nil, nil, fmt.Errorf("projects %s and %s have the same name %q in the backup", existingPath, project.path, project.name)
+		}
+
+		projectPaths[project.name] = project.path
+		projects = append(projects, project)
+	}
+
+	for projectName := range unmatchedProjectNames {
+		run.logWarning(fmt.Sprintf("Project %q isn't found in the projects directories", projectName))
+	}
+
+	// Plain dirs are given one by one, so they are neither selected nor excluded by name
+	for _, plainDirPath := range run.config.PlainDirs {
+		if info, err := os.Stat(plainDirPath); err != nil {
+			return nil, nil, err
+		} else if !info.IsDir() {
+			return nil, nil, fmt.Errorf("%s isn't a directory", plainDirPath)
+		}
+
+		plainDir := project{name: run.plainDirName(plainDirPath), path: plainDirPath, isPlain: true}
+
+		if existingPath, ok := projectPaths[plainDir.name]; ok {
+			return nil, nil, fmt.Errorf("%s and %s have the same name %q in the backup", existingPath, plainDir.path, plainDir.name)
+		}
+
+		projectPaths[plainDir.name] = plainDir.path
+		projects = append(projects, plainDir)
+	}
+
+	return projects, skippedProjects, nil
+}
+
+// findProjectsIn lists the git projects in a projects dir.
+// In recursive mode, nested directories are searched as well until a git project is found.
+//
+// The projects dir is resolved first, as it's often a symlink to where the projects actually are.
+// Symlinked dirs inside it are followed after the regular dirs are searched, but only if their target wasn't reached already,
+// so that a link to an ancestor doesn't loop forever and a linked project isn't backed up twice. They are skipped with a warning otherwise.
+func (run *backupRun) findProjectsIn(projectsPath string) ([]project, error) {
+	resolvedProjectsPath, err := filepath.EvalSymlinks(projectsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	search := projectSearch{
+		run:         run,
+		projects:    []project{},
+		visitedDirs: map[string]struct{}{resolvedProjectsPath: {}},
+	}
+
+	if err := search.searchDir(resolvedProjectsPath, ".", resolvedProjectsPath); err != nil {
+		return nil, err
+	}
+
+	for len(search.links) > 0 {
+		link := search.links[0]
+		search.links = search.links[1:]
+
+		resolvedLinkPath, err := filepath.EvalSymlinks(link.path)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, isVisited := search.visitedDirs[resolvedLinkPath]; isVisited {
+			run.logWarning(fmt.Sprintf("Skipping %s, as it links to %s, which is already searched", link.path, resolvedLinkPath))
+			continue
+		}
+
+		if err := search.visitDir(link.path, link.name, resolvedLinkPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return search.projects, nil
+}
+
+// projectSearch is the state of searching a projects dir for the git projects
+type projectSearch struct {
+	run         *backupRun
+	projects    []project           // Projects found so far, named by their path relative to the projects dir
+	visitedDirs map[string]struct{} // Resolved paths of the dirs found so far
+	links       []project           // Symlinked dirs waiting to be followed, named like the projects
+}
+
+// searchDir searches the subdirs of a dir for the git projects. The symlinked subdirs are queued to be followed later.
+// The resolved path of a regular subdir is derived from its parent, so only the symlinks are resolved.
+func (search *projectSearch) searchDir(dirPath, dirRelPath, resolvedDirPath string) error {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(dirPath, entry.Name())
+		entryRelPath := filepath.Join(dirRelPath, entry.Name())
+
+		// Windows junctions are followed like symlinks, as they are the common way to link dirs there
+		if entry.Type()&(fs.ModeSymlink|fs.ModeIrregular) != 0 {
+			// A link to a file or a broken link isn't a project either
+			if info, err := os.Stat(entryPath); err == nil && info.IsDir() {
+				search.links = append(search.links, project{name: entryRelPath, path: entryPath})
+			}
+
+			continue
+		}
+
+		if !entry.IsDir() {
+			continue
+		}
+
+		if err := search.visitDir(entryPath, entryRelPath, filepath.Join(resolvedDirPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// visitDir adds the dir as a project if it's a git project. Otherwise in recursive mode, its subdirs are searched.
+func (search *projectSearch) visitDir(dirPath, dirRelPath, resolvedDirPath string) error {
+	search.visitedDirs[resolvedDirPath] = struct{}{}
+
+	if isGitProject(dirPath) {
+		search.projects = append(search.projects, project{name: dirRelPath, path: dirPath})
+
+		// Files inside a project are handled by git, including any nested repository
+		return nil
+	}
+
+	if !search.run.config.Recursive {
+		search.run.reportNonGitDir(dirPath, "as it has no .git")
+		return nil
+	}
+
+	projectsCount := len(search.projects)
+	if err := search.searchDir(dirPath, dirRelPath, resolvedDirPath); err != nil {
+		return err
+	}
+
+	// Nested dirs without a project are expected while searching, so only the dirs right inside the projects dir are reported
+	if len(search.projects) == projectsCount && !strings.Contains(dirRelPath, string(filepath.Separator)) {
+		search.run.reportNonGitDir(dirPath, "as no git project is found inside it")
+	}
+
+	return nil
+}
+
+// reportNonGitDir tells about a dir of the projects dir that isn't backed up, like a repository whose .git got deleted.
+// It's only printed in verbose mode, unless "--warn-non-git" asks for a warning.
+func (run *backupRun) reportNonGitDir(dirPath, reason string) {
+	message := fmt.Sprintf("Skipping %s, %s", dirPath, reason)
+
+	if run.config.WarnNonGitDirs {
+		run.logWarning(message)
+	} else {
+		run.logVerbose(message)
+	}
+}
+
+// plainDirName returns the name that a plain dir is backed up under, its dir name inside the plain dirs prefix
+func (run *backupRun) plainDirName(plainDirPath string) string {
+	return filepath.Join(run.config.PlainDirsPrefix, filepath.Base(plainDirPath))
+}
+
+// isGitProject reports whether the directory is the root of a git project
+func isGitProject(dirPath string) bool {
+	_, err := os.Stat(filepath.Join(dirPath, ".git"))
+
+	return !os.IsNotExist(err)
+}
+
+// resolveGitDir returns the path of the git directory of a project.
+// Linked worktrees and submodules have a ".git" file containing "gitdir: <path>" instead of a directory.
+func resolveGitDir(projectDirPath string) (string, error) {
+	dotGitPath := filepath.Join(projectDirPath, ".git")
+
+	info, err := os.Stat(dotGitPath)
+	if err != nil {
+		return "", err
+	}
+
+	if info.IsDir() {
+		return dotGitPath, nil
+	}
+
+	content, err := os.ReadFile(dotGitPath)
+	if err != nil {
+		return "", err
+	}
+
+	gitDirPath, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir:")
+	if !ok {
+		return "", fmt.Errorf("%s is not a valid gitdir file", dotGitPath)
+	}
+
+	gitDirPath = filepath.FromSlash(strings.TrimSpace(gitDirPath))
+	if !filepath.IsAbs(gitDirPath) {
+		gitDirPath = filepath.Join(projectDirPath, gitDirPath)
+	}
+
+	if _, err := os.Stat(gitDirPath); err != nil {
+		return "", fmt.Errorf("gitdir of the worktree is missing: %w", err)
+	}
+
+	return gitDirPath, nil
+}
+
+// projectScan is the list of files to back up from a project
+type projectScan struct {
+	index            int           // Position of the project in the scan queue
+	files            []backupFile  // Files to back up, including the generated ones
+	excludedRelPaths []string      // Files skipped via the exclude patterns
+	emptyDirRelPaths []string      // Empty force-included dirs to mirror in the backup
+	isUnchanged      bool          // Whether the project wasn't scanned, as nothing changed since its last backup
+	isTruncated      bool          // Whether the project wasn't scanned, as the time budget was exceeded
+	startedAt        time.Time     // Time the scan started, which the next run compares the project with
+	duration         time.Duration // Time it took to list the files
+	err              error         // Error that prevented the project from being scanned
+}
+
+// hasChangesSince reports whether any file or directory of the project, including its git dir, was modified at or after the time.
+// A created, removed or renamed file updates the modification time of its directory, and a commit or a fetch writes to the git dir.
+// It errs on the side of a change if the project can't be walked.
+//
+// The git index is checked first, as staging, committing and checking out all rewrite it, so a busy project isn't walked at all.
+// The object store isn't walked, as every new object comes with an updated ref or index, and it's usually the largest part of a project.
+func hasChangesSince(projectDirPath string, since time.Time) bool {
+	if info, err := os.Stat(filepath.Join(projectDirPath, ".git", "index")); err == nil && !info.ModTime().Before(since) {
+		return true
+	}
+
+	errChanged := errors.New("changed")
+	objectsDirPath := filepath.Join(projectDirPath, ".git", "objects")
+
+	err := filepath.WalkDir(projectDirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == objectsDirPath {
+			return filepath.SkipDir
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if !info.ModTime().Before(since) {
+			return errChanged
+		}
+
+		return nil
+	})
+
+	return err != nil
+}
+
+// scanProject lists every file of a project that needs backing up
+func (run *backupRun) scanProject(project project) projectScan {
+	scan := projectScan{}
+
+	includedFiles, emptyDirRelPaths, err := run.listProjectFiles(project)
+	if err != nil {
+		scan.err = err
+		return scan
+	}
+
+	ignorePatterns, err := readPatternFile(filepath.Join(project.path, ignoreFileName))
+	if err != nil {
+		scan.err = err
+		return scan
+	}
+
+	// A file can be listed more than once, e.g. when it's both changed and unpushed, or force-included as well
+	seenFiles := make(map[string]struct{}, len(includedFiles))
+
+	// Sanitized or flattened backup paths mapped to the source paths they were renamed from
+	renamedRelPaths := make(map[string]string)
+
+	// renameFile changes the backup path of the file via "--sanitize-names" and "--flatten".
+	// The source path is recorded, so that restoring brings it back.
+	renameFile := func(file *backupFile) error {
+		renamedRelPath := file.relPath
+		if run.config.SanitizeNames {
+			renamedRelPath = sanitizeRelPath(renamedRelPath)
+		}
+		if run.config.Flatten {
+			renamedRelPath = flattenRelPath(renamedRelPath)
+		}
+
+		if renamedRelPath == file.relPath {
+			return nil
+		}
+
+		// Different paths can be renamed into the same one, which would overwrite each other in the backup
+		if sourceRelPath, ok := renamedRelPaths[renamedRelPath]; ok {
+			renaming := "sanitized names"
+			if run.config.Flatten {
+				renaming = "flattened paths"
+			}
+
+			return fmt.Errorf("%s and %s are both backed up as %s with %s", sourceRelPath, file.relPath, renamedRelPath, renaming)
+		}
+		renamedRelPaths[renamedRelPath] = file.relPath
+
+		file.sourceRelPath = file.relPath
+		file.relPath = renamedRelPath
+
+		return nil
+	}
+
+	// Add current project dir to the each element in the includedFiles
+	for _, includedFile := range includedFiles {
+		if strings.TrimSpace(includedFile) == "" {
+			continue
+		}
+
+		if _, ok := seenFiles[includedFile]; ok {
+			continue
+		}
+		seenFiles[includedFile] = struct{}{}
+
+		if matchAnyPattern(run.config.Exclude, includedFile) || isIgnored(ignorePatterns, includedFile) {
+			scan.excludedRelPaths = append(scan.excludedRelPaths, filepath.Join(project.name, includedFile))
+			continue
+		}
+
+		file := backupFile{
+			projectName: project.name,
+			relPath:     filepath.Join(project.name, includedFile),
+			path:        filepath.Join(project.path, includedFile),
+		}
+
+		if err := renameFile(&file); err != nil {
+			scan.err = err
+			return scan
+		}
+
+		scan.files = append(scan.files, file)
+	}
+
+	for _, emptyDirRelPath := range emptyDirRelPaths {
+		if matchAnyPattern(run.config.Exclude, emptyDirRelPath) || isIgnored(ignorePatterns, emptyDirRelPath) {
+			continue
+		}
+
+		emptyDirRelPath = filepath.Join(project.name, emptyDirRelPath)
+		if run.config.SanitizeNames {
+			emptyDirRelPath = sanitizeRelPath(emptyDirRelPath)
+		}
+		if run.config.Flatten {
+			emptyDirRelPath = flattenRelPath(emptyDirRelPath)
+		}
+
+		scan.emptyDirRelPaths = append(scan.emptyDirRelPaths, emptyDirRelPath)
+	}
+
+	if project.isPlain {
+		return scan
+	}
+
+	if len(run.config.GitSubpaths) > 0 {
+		gitDirPath, err := resolveGitDir(project.path)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+
+		gitFileRelPaths, err := run.listGitSubpathFiles(gitDirPath)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+
+		// Linked worktrees have their git dir elsewhere, but it's backed up as the ".git" dir of the project
+		for _, gitFileRelPath := range gitFileRelPaths {
+			file := backupFile{
+				projectName: project.name,
+				relPath:     filepath.Join(project.name, ".git", gitFileRelPath),
+				path:        filepath.Join(gitDirPath, gitFileRelPath),
+			}
+
+			if err := renameFile(&file); err != nil {
+				scan.err = err
+				return scan
+			}
+
+			scan.files = append(scan.files, file)
+		}
+	}
+
+	generatedFiles := []generatedFile{}
+
+	detachedHeadNote, err := run.createDetachedHeadNote(project.path)
+	if err != nil {
+		scan.err = err
+		return scan
+	}
+
+	if detachedHeadNote != nil {
+		generatedFiles = append(generatedFiles, *detachedHeadNote)
+	}
+
+	if run.config.IncludeStashes {
+		stashPatches, err := run.listStashPatches(project.path)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+
+		generatedFiles = append(generatedFiles, stashPatches...)
+	}
+
+	if run.config.IncludeCommitPatches {
+		commitPatches, err := run.listCommitPatches(project.path)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+
+		generatedFiles = append(generatedFiles, commitPatches...)
+	}
+
+	if run.config.IncludeTags {
+		unpushedTags, err := run.listUnpushedTags(project.path)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+
+		generatedFiles = append(generatedFiles, unpushedTags...)
+	}
+
+	if run.config.AllBranches {
+		branchPatches, err := run.listBranchPatches(project.path)
+		if err != nil {
+			scan.err = err
+			return scan
+		}
+
+		generatedFiles = append(generatedFiles, branchPatches...)
+	}
+
+	for _, generatedFile := range generatedFiles {
+		scan.files = append(scan.files, backupFile{
+			projectName: project.name,
+			relPath:     filepath.Join(project.name, generatedFile.relPath),
+			content:     generatedFile.content,
+		})
+	}
+
+	return scan
+}
+
+// backupFile is a single file selected for backup from one of the projects
+type backupFile struct {
+	projectName   string // Name of the project the file belongs to, see [project]
+	relPath       string // File path relative to the backup dir
+	sourceRelPath string // File path relative to the projects dir, if it differs from the relPath via "--sanitize-names"
+	path          string // Full path of the file in the project. Empty for the generated files.
+	content       []byte // Content of a generated file, see [generatedFile]. Nil for the regular project files.
+}
+
+// copyJob is a file waiting to be copied into the backup dir by one of the workers
+type copyJob struct {
+	index      int        // Position of the job in the queue, used for ordering the results
+	file       backupFile // File to be copied
+	isBackedUp bool       // Whether an older copy of the file already exists in the backup dir
+	size       int64      // Size of the file at the time of listing
+	modTime    time.Time  // Modification time of the file at the time of listing, zero for the generated files
+}
+
+// capTotalSize keeps the most recently modified files whose total size fits in the max total size, in their original order.
+// A file that doesn't fit is dropped, while the older ones may still fill the rest. The generated files are always kept.
+func capTotalSize(jobs []copyJob, maxTotalSize int64) (keptJobs, droppedJobs []copyJob) {
+	totalSize := int64(0)
+	for _, job := range jobs {
+		if job.file.content != nil {
+			totalSize += job.size
+		}
+	}
+
+	newestFirst := slices.Clone(jobs)
+	slices.SortStableFunc(newestFirst, func(a, b copyJob) int {
+		return b.modTime.Compare(a.modTime)
+	})
+
+	isDropped := make(map[int]bool)
+
+	for _, job := range newestFirst {
+		if job.file.content != nil {
+			continue
+		}
+
+		if totalSize+job.size > maxTotalSize {
+			isDropped[job.index] = true
+			continue
+		}
+
+		totalSize += job.size
+	}
+
+	for _, job := range jobs {
+		if isDropped[job.index] {
+			droppedJobs = append(droppedJobs, job)
+			continue
+		}
+
+		job.index = len(keptJobs)
+		keptJobs = append(keptJobs, job)
+	}
+
+	return keptJobs, droppedJobs
+}
+
+type copyResult struct {
+	index         int            // Position of the corresponding job in the queue
+	isChanged     bool           // Whether the file is new or changed since the last backup
+	changeReason  string         // How a backed up file was detected as changed, like "size differs"
+	manifestEntry *manifestEntry // Updated state of the backed up file, nil if unknown or unchanged
+	warning       string         // Problem that didn't fail the copy, like the file changing while being copied
+	isTruncated   bool           // Whether the file wasn't copied, as the time budget was exceeded
+	isKept        bool           // Whether the changed file wasn't copied, as the backup is newer
+	isDeleted     bool           // Whether the file wasn't copied, as it was deleted after being listed
+	err           error          // Error encountered while copying the file
+}
+
+// runCopyJob copies a file into the backup dir unless the existing backup is already up to date.
+// In dry-run mode, it only reports whether the file would be copied.
+func (run *backupRun) runCopyJob(job copyJob) copyResult {
+	result := copyResult{index: job.index}
+
+	projectFilePath := job.file.path
+	backupFilePath := filepath.Join(run.config.BackupDir, job.file.relPath)
+
+	if job.file.content != nil {
+		return run.writeGeneratedFile(job, backupFilePath)
+	}
+
+	projectFileInfo, err := os.Lstat(projectFilePath)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	if job.isBackedUp {
+		// Unchanged since the last backup according to the manifest, so neither of the files has to be read.
+		// A check compares the actual content instead, in case the backup was modified since.
+		if entry, ok := run.backupManifest[job.file.relPath]; ok && entry.matches(projectFileInfo) && !run.config.Check {
+			if run.copyProgress != nil {
+				run.copyProgress.add(job.size)
+			}
+
+			return result
+		}
+
+		var isChanged bool
+		if run.config.Check && !isSymlink(projectFileInfo) {
+			isChanged, err = run.isContentChanged(projectFilePath, backupFilePath)
+			result.changeReason = "content differs"
+		} else {
+			isChanged, result.changeReason, err = run.isFileChanged(projectFilePath, backupFilePath)
+		}
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		if !isChanged {
+			if run.copyProgress != nil {
+				run.copyProgress.add(job.size)
+			}
+
+			// Record the file, so the next run can skip it without reading.
+			// The quick compare mode never reads the unchanged files, unless their digests are needed for the objects or the checksums.
+			isHashNeeded := run.config.CompareMode != compareModeQuick || run.config.Dedup || run.config.Checksums
+			if !isSymlink(projectFileInfo) && !run.config.DryRun && isHashNeeded {
+				hash, err := hashFile(projectFilePath)
+				if err != nil {
+					result.err = err
+					return result
+				}
+
+				result.manifestEntry = newManifestEntry(projectFileInfo, hash)
+			}
+
+			return result
+		}
+
+		// The copies keep the modification time of their source, so a newer backup was edited after being copied.
+		// Object pointers are written at the time of the copy, so they are never considered edited.
+		if run.config.OverwriteOnlyIfNewer && !run.config.Check {
+			isNewer, err := isBackupNewer(projectFileInfo, backupFilePath)
+			if err != nil {
+				result.err = err
+				return result
+			}
+
+			if isNewer {
+				result.warning = fmt.Sprintf("%s is newer in the backup than in the project, keeping the backup", job.file.relPath)
+				result.isKept = true
+				return result
+			}
+		}
+	}
+
+	// Copy files that are changed or newly added
+	result.isChanged = true
+
+	if !run.config.DryRun {
+		hash, err := run.copyFileWithRetries(projectFilePath, backupFilePath)
+
+		// A mismatch is usually caused by a flaky target drive, so the copy is retried once
+		if err == nil && run.config.Verify && hash != nil {
+			if err = run.verifyCopy(backupFilePath, hash); err != nil {
+				run.logWarning(err, "- retrying")
+
+				hash, err = run.copyFileWithRetries(projectFilePath, backupFilePath)
+				if err == nil {
+					err = run.verifyCopy(backupFilePath, hash)
+				}
+			}
+		}
+
+		// The raw error of an invalid name differs by OS and filesystem, so the likely cause is pointed out
+		if err != nil && !run.config.SanitizeNames && hasInvalidNameChars(job.file.relPath) {
+			err = fmt.Errorf("%w (the name may be invalid on the backup filesystem, try \"--sanitize-names\")", err)
+		}
+
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		if isSymlink(projectFileInfo) {
+			return result
+		}
+
+		// A file written by a build or an editor while being copied can end up torn in the backup,
+		// so it's copied once more if it changed meanwhile, and reported if it keeps changing
+		copiedInfo := projectFileInfo
+		isModified, err := isModifiedSince(projectFilePath, &projectFileInfo)
+		if err == nil && isModified {
+			copiedInfo = projectFileInfo
+			hash, err = run.copyFileWithRetries(projectFilePath, backupFilePath)
+			if err == nil {
+				isModified, err = isModifiedSince(projectFilePath, &projectFileInfo)
+			}
+		}
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		// The entry records the digest of what was actually copied, so that its object is kept and the checksums match it.
+		// Its size and modification time are from before the last change, so the next run compares the file again.
+		if isModified {
+			result.warning = fmt.Sprintf("%s was modified during the backup, its copy may be inconsistent", job.file.relPath)
+			result.manifestEntry = newManifestEntry(copiedInfo, hash)
+			return result
+		}
+
+		result.manifestEntry = newManifestEntry(projectFileInfo, hash)
+	}
+
+	return result
+}
+
+// isBackupNewer reports whether the backup file was modified after the project file, ignoring the object pointers
+func isBackupNewer(projectFileInfo fs.FileInfo, backupFilePath string) (bool, error) {
+	backupFileInfo, err := os.Lstat(backupFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	if !backupFileInfo.ModTime().After(projectFileInfo.ModTime()) {
+		return false, nil
+	}
+
+	objectHash, err := readObjectPointer(backupFilePath)
+
+	return objectHash == nil, err
+}
+
+// isModifiedSince reports whether the size or the modification time of the file differs from the given info,
+// which is then replaced with the current one
+func isModifiedSince(path string, info *fs.FileInfo) (bool, error) {
+	currentInfo, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+
+	isModified := currentInfo.Size() != (*info).Size() || !currentInfo.ModTime().Equal((*info).ModTime())
+	*info = currentInfo
+
+	return isModified, nil
+}
+
+// writeGeneratedFile writes the generated content into the backup dir unless the backup already has the same content
+func (run *backupRun) writeGeneratedFile(job copyJob, backupFilePath string) copyResult {
+	result := copyResult{index: job.index}
+
+	if job.isBackedUp {
+		backupFileContent, err := os.ReadFile(backupFilePath)
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		if bytes.Equal(backupFileContent, job.file.content) {
+			if run.copyProgress != nil {
+				run.copyProgress.add(job.size)
+			}
+
+			return result
+		}
+	}
+
+	result.isChanged = true
+
+	if !run.config.DryRun {
+		_, result.err = run.writeFile(backupFilePath, bytes.NewReader(job.file.content), nil)
+	}
+
+	return result
+}
+
+// verifyCopy re-reads the copied file and compares its digest with the one computed from the source during the copy
+func (run *backupRun) verifyCopy(backupFilePath string, sourceHash []byte) error {
+	backupFileHash, err := run.hashBackupFile(backupFilePath)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(backupFileHash, sourceHash) {
+		return fmt.Errorf("verification failed, %s doesn't match the source", backupFilePath)
+	}
+
+	return nil
+}
+
+// The compare modes of "--compare-mode", which decide how the files with a different modification time than their backup are compared
+const (
+	compareModeHash  = "hash"  // Compare the same-sized files by their SHA-256 digests, the default
+	compareModeQuick = "quick" // Assume the files changed without reading them
+	compareModeGit   = "git"   // Compare the files via "git diff --no-index"
+)
+
+// isFileChanged reports whether the backed up file differs from the project file, and how it was detected.
+// Files with the same size and modification time are assumed to be identical, otherwise same-sized files are compared
+// by their SHA-256 digests. The "quick" compare mode assumes them changed instead, and the "git" mode diffs them via git.
+func (run *backupRun) isFileChanged(projectFilePath, backupFilePath string) (isChanged bool, reason string, err error) {
+	projectFileInfo, err := os.Lstat(projectFilePath)
+	if err != nil {
+		return false, "", err
+	}
+
+	backupFileInfo, err := os.Lstat(backupFilePath)
+	if err != nil {
+		return false, "", err
+	}
+
+	// Symlinks are backed up as links, so they are compared by their targets
+	if isSymlink(projectFileInfo) || isSymlink(backupFileInfo) {
+		if !isSymlink(projectFileInfo) || !isSymlink(backupFileInfo) {
+			return true, "file type differs", nil
+		}
+
+		projectFileTarget, err := os.Readlink(projectFilePath)
+		if err != nil {
+			return false, "", err
+		}
+
+		backupFileTarget, err := os.Readlink(backupFilePath)
+		if err != nil {
+			return false, "", err
+		}
+
+		return projectFileTarget != backupFileTarget, "link target differs", nil
+	}
+
+	// A compressed backup or an object pointer has a different size, so only the content they stand for can be compared
+	if !run.isCompressed(backupFilePath) && !run.config.Dedup && projectFileInfo.Size() != backupFileInfo.Size() {
+		return true, "size differs", nil
+	}
+
+	if projectFileInfo.ModTime().Equal(backupFileInfo.ModTime()) {
+		return false, "", nil
+	}
+
+	switch run.config.CompareMode {
+	case compareModeQuick:
+		return true, "modification time differs", nil
+
+	// Only the backups stored as is can be diffed. The compressed and the deduplicated ones are compared by their digests.
+	case compareModeGit:
+		if !run.isCompressed(backupFilePath) && !run.config.Dedup {
+			isChanged, err := run.isGitDiffChanged(projectFilePath, backupFilePath)
+			return isChanged, "git diff differs", err
+		}
+	}
+
+	projectFileHash, err := hashFile(projectFilePath)
+	if err != nil {
+		return false, "", err
+	}
+
+	backupFileHash, err := run.hashBackupFile(backupFilePath)
+	if err != nil {
+		return false, "", err
+	}
+
+	return !bytes.Equal(projectFileHash, backupFileHash), "sha256 differs", nil
+}
+
+// isContentChanged reports whether the backed up file has a different content than the regular project file,
+// without assuming files with the same size and modification time are identical
+func (run *backupRun) isContentChanged(projectFilePath, backupFilePath string) (bool, error) {
+	backupFileInfo, err := os.Lstat(backupFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	if isSymlink(backupFileInfo) {
+		return true, nil
+	}
+
+	projectFileHash, err := hashFile(projectFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	backupFileHash, err := run.hashBackupFile(backupFilePath)
+	if err != nil {
+		return false, err
+	}
+
+	return !bytes.Equal(projectFileHash, backupFileHash), nil
+}
+
+// hashFile returns the SHA-256 digest of a file's content
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// listProjectFiles returns the paths, relative to the project dir, of every file that needs backing up,
+// along with the empty dirs inside the force-included dirs
+func (run *backupRun) listProjectFiles(project project) (includedFiles, emptyDirRelPaths []string, err error) {
+	projectDirPath := project.path
+
+	// A plain dir has no git to tell its changes, so every file of it is backed up
+	if project.isPlain {
+		return run.walkFiles(projectDirPath, projectDirPath)
+	}
+
+	// Git commands work the same from a linked worktree, as long as the repository it points to still exists
+	if _, err := resolveGitDir(projectDirPath); err != nil {
+		return nil, nil, err
+	}
+
+	includedFiles, err = run.listChangedFiles(project)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	forceIncludedFiles, emptyDirRelPaths, err := run.listForceIncludedFiles(projectDirPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	includedFiles = append(includedFiles, forceIncludedFiles...)
+
+	ignoredFiles, err := run.listIncludedIgnoredFiles(projectDirPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	includedFiles = append(includedFiles, ignoredFiles...)
+
+	return includedFiles, emptyDirRelPaths, nil
+}
+
+// listIncludedIgnoredFiles returns the paths, relative to the project dir, of the git ignored files matching "--include-ignored".
+// Unlike a force-included glob, only the untracked files git reports as ignored are matched, so the git dir is never walked.
+func (run *backupRun) listIncludedIgnoredFiles(projectDirPath string) ([]string, error) {
+	includedFiles := []string{}
+	if len(run.config.IncludeIgnored) == 0 {
+		return includedFiles, nil
+	}
+
+	// --ignored: Only the untracked files excluded by .gitignore and other git excluded files
+	ignoredFiles, err := run.listGitPaths(projectDirPath, "ls-files", "--others", "--ignored", "--exclude-standard", "--full-name")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ignoredFile := range ignoredFiles {
+		if ignoredFile == "" {
+			continue
+		}
+
+		for _, pattern := range run.config.IncludeIgnored {
+			if matchPattern(pattern, ignoredFile) {
+				includedFiles = append(includedFiles, ignoredFile)
+				break
+			}
+		}
+	}
+
+	return includedFiles, nil
+}
+
+// listChangedFiles returns the paths, relative to the project dir, of the untracked, changed and unpushed files.
+// With "--include-submodules", the files of the submodules are listed recursively as well.
+func (run *backupRun) listChangedFiles(project project) ([]string, error) {
+	projectDirPath := project.path
+	includedFiles := []string{}
+
+	if run.config.Untracked {
+		// --others: Untracked files not yet added by `git add`
+		// --full-name: Output relative paths
+		untrackedFilesArgs := []string{"ls-files", "--others", "--full-name"}
+		if !run.config.UntrackedIgnored {
+			// --exclude-standard: Ignore .gitignore and other git excluded files
+			untrackedFilesArgs = append(untrackedFilesArgs, "--exclude-standard")
+		}
+
+		untrackedFiles, err := run.listGitPaths(projectDirPath, untrackedFilesArgs...)
+		if err != nil {
+			return nil, err
+		}
+
+		includedFiles = append(includedFiles, untrackedFiles...)
+	}
+
+	// With "--no-renames", the diffs below list a rename as both its old and new path regardless of the "diff.renames" setting.
+	// The missing old path is skipped like any deleted file, so its backup is removed while the new path is backed up.
+	if run.config.Unstaged {
+		// Working tree changes that are not yet added by `git add`
+		unstagedFiles, err := run.listGitPaths(projectDirPath, "diff", "--name-only", "--no-renames")
+		if err != nil {
+			return nil, err
+		}
+
+		includedFiles = append(includedFiles, unstagedFiles...)
+	}
+
+	if run.config.Staged {
+		// Changes that are added by `git add` but not yet committed
+		stagedFiles, err := run.listGitPaths(projectDirPath, "diff", "--cached", "--name-only", "--no-renames")
+		if err != nil {
+			return nil, err
+		}
+
+		includedFiles = append(includedFiles, stagedFiles...)
+	}
+
+	if run.config.Unpushed {
+		branchName, err := run.currentBranch(projectDirPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Current branch name is empty when a specific commit is checked out
+		remote := run.projectRemote(projectDirPath)
+		unpushedBase, isFallback, err := run.findUnpushedBase(projectDirPath, remote, branchName)
+		if err != nil {
+			return nil, err
+		}
+
+		unpushedFilesArgs := []string{"diff", "--name-only", "--no-renames", unpushedBase, "HEAD"}
+
+		if isFallback {
+			missingRemoteMessage := fmt.Sprintf("%s/%s doesn't exist", remote, branchName)
+			if branchName == "" {
+				missingRemoteMessage = "detached HEAD isn't on any remote branch"
+			}
+
+			if unpushedBase == "" {
+				run.logWarning(fmt.Sprintf("%s: %s and none of its commits are on a remote either, backing up every tracked file",
+					project.name, missingRemoteMessage))
+
+				unpushedFilesArgs = []string{"ls-files", "--full-name"}
+			} else {
+				run.logWarning(fmt.Sprintf("%s: %s, backing up the changes since it forked from a remote branch",
+					project.name, missingRemoteMessage))
+			}
+		}
+
+		// Files that are in local commits but not yet pushed to the remote.
+		// A project without any commit has nothing to diff, but any other failure, like a corrupt repository, leaves files out.
+		unpushedFiles, err := run.listGitPaths(projectDirPath, unpushedFilesArgs...)
+		if err != nil && run.refExists(projectDirPath, "HEAD") {
+			run.logWarning(fmt.Sprintf("%s: %v, the unpushed files may be missing from the backup", project.name, err))
+		}
+
+		includedFiles = append(includedFiles, unpushedFiles...)
+	}
+
+	if run.config.IncludeSubmodules {
+		submoduleRelPaths, err := run.listSubmodules(project)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, submoduleRelPath := range submoduleRelPaths {
+			submodule := project
+			submodule.name = filepath.Join(project.name, submoduleRelPath)
+			submodule.path = filepath.Join(projectDirPath, submoduleRelPath)
+
+			submoduleFiles, err := run.listChangedFiles(submodule)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, submoduleFile := range submoduleFiles {
+				if submoduleFile != "" {
+					includedFiles = append(includedFiles, filepath.Join(submoduleRelPath, submoduleFile))
+				}
+			}
+		}
+	}
+
+	return includedFiles, nil
+}
+
+// walkFiles returns the paths, relative to the base dir, of every file in the dir.
+// The empty dirs are returned separately with "--copy-empty-dirs", as they have no files to list.
+func (run *backupRun) walkFiles(baseDirPath, dirPath string) (fileRelPaths, emptyDirRelPaths []string, err error) {
+	err = filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		entryRelPath, err := filepath.Rel(baseDirPath, path)
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			fileRelPaths = append(fileRelPaths, entryRelPath)
+			return nil
+		}
+
+		if run.config.CopyEmptyDirs {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return err
+			}
+
+			if len(entries) == 0 {
+				emptyDirRelPaths = append(emptyDirRelPaths, entryRelPath)
+			}
+		}
+
+		return nil
+	})
+
+	return fileRelPaths, emptyDirRelPaths, err
+}
+
+// listForceIncludedFiles returns the paths, relative to the project dir, of the files included via "--force-include".
+// The empty dirs found while walking the force-included dirs are returned separately, as they have no files to list.
+func (run *backupRun) listForceIncludedFiles(projectDirPath string) (includedFiles, emptyDirRelPaths []string, err error) {
+	includedFiles = []string{}
+	emptyDirRelPaths = []string{}
+
+	// Files found by walking the force-included directories
+	walkedFiles := []string{}
+
+	// Glob patterns are resolved by walking the whole project, so the rest are handled as literal paths
+	globPatterns := []string{}
+	forceIncludedRelPaths := []string{}
+
+	for _, forceIncludedRelPath := range run.config.ForceInclude {
+		if isGlobPattern(forceIncludedRelPath) {
+			globPatterns = append(globPatterns, forceIncludedRelPath)
+		} else {
+			forceIncludedRelPaths = append(forceIncludedRelPaths, forceIncludedRelPath)
+		}
+	}
+
+	if len(globPatterns) > 0 {
+		matchedDirRelPaths, matchedFiles, err := findMatchingPaths(projectDirPath, globPatterns)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		includedFiles = append(includedFiles, matchedFiles...)
+		forceIncludedRelPaths = append(forceIncludedRelPaths, matchedDirRelPaths...)
+	}
+
+	for _, forceIncludedRelPath := range forceIncludedRelPaths {
+		forceIncludedPath := filepath.Join(projectDirPath, forceIncludedRelPath)
+
+		info, err := os.Stat(forceIncludedPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if info.IsDir() {
+			dirFiles, dirEmptyDirRelPaths, err := run.walkFiles(projectDirPath, forceIncludedPath)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			walkedFiles = append(walkedFiles, dirFiles...)
+			emptyDirRelPaths = append(emptyDirRelPaths, dirEmptyDirRelPaths...)
+		} else {
+			includedFiles = append(includedFiles, forceIncludedRelPath)
+		}
+	}
+
+	if run.config.ForceIncludeGitignore && len(walkedFiles) > 0 {
+		ignoredFiles, err := run.listGitIgnoredFiles(projectDirPath, walkedFiles)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, walkedFile := range walkedFiles {
+			if _, ok := ignoredFiles[walkedFile]; !ok {
+				includedFiles = append(includedFiles, walkedFile)
+			}
+		}
+	} else {
+		includedFiles = append(includedFiles, walkedFiles...)
+	}
+
+	return includedFiles, emptyDirRelPaths, nil
+}
+
+// listGitIgnoredFiles returns the subset of the paths that are ignored by the git ignore rules of the project.
+// Tracked files are never reported as ignored.
+func (run *backupRun) listGitIgnoredFiles(projectDirPath string, relPaths []string) (map[string]struct{}, error) {
+	stdin := strings.Builder{}
+	for _, relPath := range relPaths {
+		stdin.WriteString(filepath.ToSlash(relPath))
+		stdin.WriteByte(0)
+	}
+
+	cmd := run.gitCommand(projectDirPath, "check-ignore", "--stdin", "-z")
+	cmd.Stdin = strings.NewReader(stdin.String())
+
+	stdout, err := cmd.Output()
+
+	// Exit code 1 means none of the paths are ignored
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return map[string]struct{}{}, nil
+	}
+	if err != nil {
+		return nil, gitError("check-ignore", err)
+	}
+
+	ignoredFiles := make(map[string]struct{})
+	for _, ignoredFile := range strings.Split(string(stdout), "\x00") {
+		if ignoredFile != "" {
+			ignoredFiles[filepath.FromSlash(ignoredFile)] = struct{}{}
+		}
+	}
+
+	return ignoredFiles, nil
+}
+
+// copyFile copies the source file to the destination and returns the SHA-256 digest of the copied content.
+// See [writeFile] for the details. Symlinks are recreated and have no digest.
+func (run *backupRun) copyFile(srcPath, dstPath string) ([]byte, error) {
+	srcPath, dstPath = longPath(srcPath), longPath(dstPath)
+
+	// Create the destination directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return nil, err
+	}
+
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recreate symlinks instead of copying the content of their targets
+	if isSymlink(srcInfo) {
+		return nil, copySymlink(srcPath, dstPath)
+	}
+
+	if run.isCompressed(dstPath) {
+		return run.compressFile(srcPath, dstPath, srcInfo)
+	}
+
+	if run.config.Dedup {
+		return run.dedupFile(srcPath, dstPath, srcInfo)
+	}
+
+	// Linking fails across filesystems, in which case the file is copied as usual
+	if run.config.Hardlink {
+		if err := linkFile(srcPath, dstPath); err == nil {
+			if run.copyProgress != nil {
+				run.copyProgress.add(srcInfo.Size())
+			}
+
+			return hashFile(srcPath)
+		}
+	}
+
+	// Open the source file for reading
+	sourceFile, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceFile.Close()
+
+	return run.writeFile(dstPath, sourceFile, srcInfo)
+}
+
+// copyFileAsIs copies a file without compressing, deduplicating or hardlinking it, like a file out of the backup dir.
+// Symlinks are recreated as links.
+func (run *backupRun) copyFileAsIs(srcPath, dstPath string) error {
+	srcPath, dstPath = longPath(srcPath), longPath(dstPath)
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	if isSymlink(srcInfo) {
+		return copySymlink(srcPath, dstPath)
+	}
+
+	sourceFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	_, err = run.writeFile(dstPath, sourceFile, srcInfo)
+
+	return err
+}
+
+// linkFile hardlinks the destination to the source file through a temporary link, so an existing destination is replaced atomically
+func linkFile(srcPath, dstPath string) error {
+	// Only a free name is needed, as the link can't be created over an existing file
+	tempFile, err := os.CreateTemp(filepath.Dir(dstPath), filepath.Base(dstPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+
+	if err := os.Remove(tempPath); err != nil {
+		return err
+	}
+
+	if err := os.Link(srcPath, tempPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, dstPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+// writeFile writes the content into a temporary file next to the destination and
+// then renames it over the destination, so the destination is never left half-written.
+// The permissions and times of the source file are preserved if its info is provided.
+// It returns the SHA-256 digest of the written content.
+func (run *backupRun) writeFile(dstPath string, content io.Reader, srcInfo fs.FileInfo) (hash []byte, err error) {
+	dstPath = longPath(dstPath)
+
+	dstDir := filepath.Dir(dstPath)
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Create a temporary file in the destination directory, so that the final rename doesn't cross devices.
+	// Leftovers from a killed run aren't part of any project, so they get removed from the backup on the next run.
+	tempFile, err := os.CreateTemp(dstDir, filepath.Base(dstPath)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	tempPath := tempFile.Name()
+
+	defer func() {
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	contentHash := sha256.New()
+
+	destination := io.MultiWriter(tempFile, contentHash)
+	if run.copyProgress != nil {
+		destination = io.MultiWriter(tempFile, contentHash, run.copyProgress)
+	}
+
+	if run.copyRateLimiter != nil {
+		content = run.copyRateLimiter.reader(content)
+	}
+
+	// Copy the contents of the source file to the temporary file
+	_, err = copyBuffered(destination, content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flush the copy from the OS cache to the disk, so it survives a power failure or an unplugged drive
+	if run.config.Fsync {
+		if err := tempFile.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return nil, err
+	}
+
+	if srcInfo != nil {
+		// Preserve the file permissions of the source file
+		if err := os.Chmod(tempPath, srcInfo.Mode()); err != nil {
+			return nil, err
+		}
+
+		// Preserve the access and modification times of the source file
+		if err := os.Chtimes(tempPath, accessTime(srcInfo), srcInfo.ModTime()); err != nil {
+			return nil, err
+		}
+	} else if err := os.Chmod(tempPath, 0644); err != nil {
+		return nil, err
+	}
+
+	// Replace the destination file with the complete copy
+	if err := os.Rename(tempPath, dstPath); err != nil {
+		return nil, err
+	}
+
+	return contentHash.Sum(nil), nil
+}
+
+// copySymlink creates a symlink at the destination pointing to the same target as the source symlink
+func copySymlink(srcPath, dstPath string) error {
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return err
+	}
+
+	return writeSymlink(target, dstPath)
+}
+
+// writeSymlink creates a symlink to the target, replacing the destination atomically like [writeFile]
+func writeSymlink(target, dstPath string) error {
+	// Reserve a unique temporary name, so the link can be renamed over the destination like a regular file
+	tempFile, err := os.CreateTemp(filepath.Dir(dstPath), filepath.Base(dstPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+
+	if err := os.Remove(tempPath); err != nil {
+		return err
+	}
+
+	if err := os.Symlink(target, tempPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempPath, dstPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+func isSymlink(info fs.FileInfo) bool {
+	return info.Mode()&fs.ModeSymlink != 0
+}
+
+// isReparsePoint reports whether the file is a Windows junction or another reparse point that isn't a symlink.
+// Go reports them as irregular files instead of dirs, so they are never walked into, but their content can't be copied either.
+func isReparsePoint(info fs.FileInfo) bool {
+	return info.Mode()&fs.ModeIrregular != 0
+}
+
+// resolveBackupPath returns the full path of a file or dir in the backup dir to be removed.
+// It fails if the path escapes the backup dir, e.g. through a parent dir that was replaced by a symlink,
+// so that nothing outside the backup dir is ever removed. The last element isn't resolved, as removing a symlink is safe.
+func (run *backupRun) resolveBackupPath(backupRelPath string) (string, error) {
+	if !filepath.IsLocal(backupRelPath) {
+		return "", fmt.Errorf("refusing to remove %s outside the backup directory", backupRelPath)
+	}
+
+	backupFilePath := filepath.Join(run.config.BackupDir, backupRelPath)
+
+	resolvedBackupPath, err := filepath.EvalSymlinks(run.config.BackupDir)
+	if err != nil {
+		return "", err
+	}
+
+	resolvedParentPath, err := filepath.EvalSymlinks(filepath.Dir(backupFilePath))
+	if err != nil {
+		return "", err
+	}
+
+	parentRelPath, err := filepath.Rel(resolvedBackupPath, resolvedParentPath)
+	if err != nil || !filepath.IsLocal(parentRelPath) {
+		return "", fmt.Errorf("refusing to remove %s, as it resolves outside the backup directory", backupFilePath)
+	}
+
+	return backupFilePath, nil
+}
@@ -0,0 +1,727 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunConcurrently(t *testing.T) {
+	const runs = 4
+
+	cfgs := make([]Config, runs)
+	for i := range cfgs {
+		projectsDirPath, backupDirPath := newTestDirs(t)
+		projectPath := newProject(t, projectsDirPath, "app")
+		writeTestFile(t, filepath.Join(projectPath, "run.txt"), fmt.Sprint(i))
+
+		cfgs[i] = testConfig(projectsDirPath, backupDirPath)
+		cfgs[i].Dedup = i%2 == 0
+	}
+
+	// The runs share nothing, which the race detector verifies with "go test -race"
+	reports := make([]Report, runs)
+	errs := make([]error, runs)
+
+	var runners sync.WaitGroup
+	for i, cfg := range cfgs {
+		runners.Add(1)
+		go func() {
+			defer runners.Done()
+			reports[i], errs[i] = Run(cfg)
+		}()
+	}
+	runners.Wait()
+
+	for i, cfg := range cfgs {
+		if errs[i] != nil || len(reports[i].Errors) > 0 {
+			t.Fatalf("run %d failed: %v %v", i, errs[i], reports[i].Errors)
+		}
+
+		assertBackedUp(t, cfg.BackupDir, "app/run.txt", fmt.Sprint(i))
+	}
+}
+
+// runWhileModifying runs the backup while the modification time of the file keeps changing, without changing its content.
+// The file is touched continuously, and the copies are throttled to 16 MB/s, so that every copy of a file larger than that sees a change.
+func runWhileModifying(t *testing.T, cfg Config, path string) Report {
+	t.Helper()
+
+	cfg.RateLimit = 16 << 20
+
+	done := make(chan struct{})
+	modified := make(chan struct{})
+	go func() {
+		defer close(modified)
+
+		modTime := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			modTime = modTime.Add(time.Second)
+			os.Chtimes(path, modTime, modTime)
+		}
+	}()
+
+	report, err := Run(cfg)
+	close(done)
+	<-modified
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(report.Warnings, func(warning string) bool { return strings.Contains(warning, "modified during the backup") }) {
+		t.Fatalf("warnings are %q, want the file reported as modified during the backup", report.Warnings)
+	}
+
+	return report
+}
+
+// sha256Hex returns the SHA-256 digest of the content as recorded in the manifest
+func sha256Hex(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestDedupKeepsObjectOfFileModifiedDuringCopy(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	filePath := filepath.Join(projectPath, "data.bin")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Dedup = true
+
+	writeTestFile(t, filePath, "old")
+	runBackup(t, cfg)
+
+	// The copied content is already in the object store when the file is copied again, so only reading it takes a while
+	newContent := strings.Repeat("new", 8<<20)
+	writeTestFile(t, filePath, newContent)
+	runWhileModifying(t, cfg, filePath)
+
+	backupManifest, _, err := readManifest(filepath.Join(backupDirPath, manifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stale entry would keep the digest of the old content, and the object of the copied content would be removed as unused
+	if got := backupManifest[filepath.Join("app", "data.bin")].Hash; got != sha256Hex(newContent) {
+		t.Errorf("manifest records %s, want the digest of the copied content %s", got, sha256Hex(newContent))
+	}
+
+	newHash := sha256.Sum256([]byte(newContent))
+	if got := readTestFile(t, newBackupRun(cfg).objectPath(newHash[:])); got != newContent {
+		t.Errorf("object of the copied content has %d bytes, want %d", len(got), len(newContent))
+	}
+
+	assertBackedUp(t, backupDirPath, "app/data.bin", newContent)
+}
+
+func TestDedupRecopiesFilePointingToMissingObject(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Dedup = true
+
+	content := "content"
+	writeTestFile(t, filepath.Join(projectPath, "file.txt"), content)
+	runBackup(t, cfg)
+
+	// A pointer file, like on a filesystem without hardlinks, whose object got lost.
+	// Without the manifest, the file is compared with its backup.
+	hash := sha256.Sum256([]byte(content))
+	writeTestFile(t, filepath.Join(backupDirPath, "app", "file.txt"), objectPointerPrefix+hex.EncodeToString(hash[:])+"\n")
+	for _, path := range []string{newBackupRun(cfg).objectPath(hash[:]), filepath.Join(backupDirPath, manifestFileName)} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := runBackup(t, cfg)
+
+	if report.FilesUpdated != 1 {
+		t.Errorf("%d files are updated, want the file pointing to the missing object", report.FilesUpdated)
+	}
+	assertBackedUp(t, backupDirPath, "app/file.txt", content)
+}
+
+func TestCopyPreservesModificationTime(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	filePath := filepath.Join(projectPath, "notes.txt")
+
+	writeTestFile(t, filePath, "notes")
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	runBackup(t, testConfig(projectsDirPath, backupDirPath))
+
+	info, err := os.Stat(filepath.Join(backupDirPath, "app", "notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := info.ModTime().Sub(modTime).Abs(); diff > time.Second {
+		t.Errorf("backup is modified at %s, want %s of the source", info.ModTime(), modTime)
+	}
+}
+
+func TestRunCopiesOnlyChangedFiles(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	filePath := filepath.Join(projectPath, "notes.txt")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+
+	writeTestFile(t, filePath, "old notes")
+	if report := runBackup(t, cfg); report.FilesCopied != 1 {
+		t.Fatalf("%d files are copied on the first run, want 1", report.FilesCopied)
+	}
+
+	if report := runBackup(t, cfg); report.FilesCopied != 0 || report.FilesUpdated != 0 {
+		t.Errorf("%d files are copied and %d updated without a change, want none", report.FilesCopied, report.FilesUpdated)
+	}
+
+	// The same size, so only the modification time tells the change apart
+	writeTestFile(t, filePath, "new notes")
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if report := runBackup(t, cfg); report.FilesUpdated != 1 {
+		t.Errorf("%d files are updated after a change, want 1", report.FilesUpdated)
+	}
+	assertBackedUp(t, backupDirPath, "app/notes.txt", "new notes")
+}
+
+func TestCopyFileWithFsync(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dedup %t", dedup), func(t *testing.T) {
+			dirPath := t.TempDir()
+			srcPath := filepath.Join(dirPath, "source.txt")
+			dstPath := filepath.Join(dirPath, "backup", "source.txt")
+
+			content := "flushed to the disk"
+			writeTestFile(t, srcPath, content)
+
+			// Flushing can't be observed without a power failure, so the copy is only checked to go through it intact
+			run := newBackupRun(Config{BackupDir: filepath.Join(dirPath, "backup"), Fsync: true, Dedup: dedup, Quiet: true})
+
+			hash, err := run.copyFile(srcPath, dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := hex.EncodeToString(hash); got != sha256Hex(content) {
+				t.Errorf("copy returned the digest %s, want %s", got, sha256Hex(content))
+			}
+			if got := readTestFile(t, dstPath); got != content {
+				t.Errorf("copy has %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+func TestRunBacksUpWorktree(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	// The ".git" of a linked worktree is a file pointing to its git dir inside the main project
+	worktreePath := filepath.Join(projectsDirPath, "app-feature")
+	git(t, projectPath, "worktree", "add", "--quiet", "-b", "feature", worktreePath)
+	writeTestFile(t, filepath.Join(worktreePath, "untracked.txt"), "untracked")
+
+	gitDirPath, err := resolveGitDir(worktreePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(projectPath, ".git", "worktrees", "app-feature"); gitDirPath != want {
+		t.Errorf("git dir of the worktree is %s, want %s", gitDirPath, want)
+	}
+
+	runBackup(t, testConfig(projectsDirPath, backupDirPath))
+
+	assertBackedUp(t, backupDirPath, "app-feature/untracked.txt", "untracked")
+}
+
+func TestRunSkipsExcludedFiles(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	for _, relPath := range []string{"notes.txt", "debug.log", "web/server.log", "config/app.json", "web/config/app.json"} {
+		writeTestFile(t, filepath.Join(projectPath, filepath.FromSlash(relPath)), relPath)
+	}
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Exclude = []string{"*.log", filepath.FromSlash("config/*.json")}
+	runBackup(t, cfg)
+
+	assertBackedUp(t, backupDirPath, "app/notes.txt", "notes.txt")
+	assertBackedUp(t, backupDirPath, "app/web/config/app.json", "web/config/app.json")
+	assertNotBackedUp(t, backupDirPath, "app/debug.log")
+	assertNotBackedUp(t, backupDirPath, "app/web/server.log")
+	assertNotBackedUp(t, backupDirPath, "app/config/app.json")
+}
+
+func TestForceIncludedDirWithNestedGitignore(t *testing.T) {
+	for _, honorGitignore := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gitignore %t", honorGitignore), func(t *testing.T) {
+			projectsDirPath, backupDirPath := newTestDirs(t)
+			projectPath := newProject(t, projectsDirPath, "app")
+
+			writeTestFile(t, filepath.Join(projectPath, "config", ".gitignore"), "secrets/\n")
+			writeTestFile(t, filepath.Join(projectPath, "config", "settings.json"), "settings")
+			writeTestFile(t, filepath.Join(projectPath, "config", "secrets", "key"), "key")
+
+			cfg := testConfig(projectsDirPath, backupDirPath)
+			cfg.ForceInclude = []string{"config"}
+			cfg.ForceIncludeGitignore = honorGitignore
+			runBackup(t, cfg)
+
+			assertBackedUp(t, backupDirPath, "app/config/settings.json", "settings")
+
+			// The whole force-included dir is backed up unless its nested ignore rules are honored
+			if honorGitignore {
+				assertNotBackedUp(t, backupDirPath, "app/config/secrets/key")
+			} else {
+				assertBackedUp(t, backupDirPath, "app/config/secrets/key", "key")
+			}
+		})
+	}
+}
+
+func TestRunAttributesFilesToTheirProjects(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+
+	// The same names in both projects, so that a git command run in the wrong dir would mix them up
+	for _, name := range []string{"app", "lib"} {
+		projectPath := newProject(t, projectsDirPath, name)
+		writeTestFile(t, filepath.Join(projectPath, "notes.txt"), name+" notes")
+	}
+
+	report := runBackup(t, testConfig(projectsDirPath, backupDirPath))
+
+	for _, name := range []string{"app", "lib"} {
+		assertBackedUp(t, backupDirPath, name+"/notes.txt", name+" notes")
+
+		if got := report.Projects[name].FilesCopied; got != 1 {
+			t.Errorf("%d files of %s are copied, want 1", got, name)
+		}
+	}
+}
+
+func TestRunBacksUpSpecialNames(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	// Without "-z", git quotes and escapes these names in its output
+	untrackedRelPath := "my notes ü.txt"
+	unpushedRelPath := "spaced dir/日本語.txt"
+	stagedRelPath := "café \"quoted\".txt"
+
+	writeTestFile(t, filepath.Join(projectPath, filepath.FromSlash(unpushedRelPath)), "unpushed")
+	git(t, projectPath, "add", ".")
+	git(t, projectPath, "commit", "--quiet", "-m", "unpushed")
+
+	writeTestFile(t, filepath.Join(projectPath, stagedRelPath), "staged")
+	git(t, projectPath, "add", ".")
+
+	writeTestFile(t, filepath.Join(projectPath, untrackedRelPath), "untracked")
+
+	runBackup(t, testConfig(projectsDirPath, backupDirPath))
+
+	assertBackedUp(t, backupDirPath, "app/"+untrackedRelPath, "untracked")
+	assertBackedUp(t, backupDirPath, "app/"+unpushedRelPath, "unpushed")
+	assertBackedUp(t, backupDirPath, "app/"+stagedRelPath, "staged")
+}
+
+func TestRunCopiesFileListedTwiceOnce(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	// Untracked, modified after being staged and force-included, so each list has it
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "staged")
+	git(t, projectPath, "add", "notes.txt")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "unstaged")
+	writeTestFile(t, filepath.Join(projectPath, "draft.txt"), "draft")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.ForceInclude = []string{"notes.txt", "draft.txt"}
+
+	report := runBackup(t, cfg)
+
+	if report.FilesCopied != 2 {
+		t.Errorf("%d files are copied, want each of the 2 files once", report.FilesCopied)
+	}
+	assertBackedUp(t, backupDirPath, "app/notes.txt", "unstaged")
+	assertBackedUp(t, backupDirPath, "app/draft.txt", "draft")
+}
+
+func TestDedupStoresIdenticalContentOnce(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+
+	content := "shared content"
+	for _, name := range []string{"app", "lib"} {
+		projectPath := newProject(t, projectsDirPath, name)
+		writeTestFile(t, filepath.Join(projectPath, "a.txt"), content)
+		writeTestFile(t, filepath.Join(projectPath, "nested", "b.txt"), content)
+	}
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Dedup = true
+	runBackup(t, cfg)
+
+	objectPaths, err := filepath.Glob(filepath.Join(backupDirPath, objectsDirName, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(content))
+	if want := newBackupRun(cfg).objectPath(hash[:]); !slices.Equal(objectPaths, []string{want}) {
+		t.Errorf("objects are %q, want only %s", objectPaths, want)
+	}
+
+	for _, relPath := range []string{"app/a.txt", "app/nested/b.txt", "lib/a.txt", "lib/nested/b.txt"} {
+		assertBackedUp(t, backupDirPath, relPath, content)
+	}
+}
+
+func TestRunKeepsFilesBehindSymlinkEscapingBackup(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	runBackup(t, cfg)
+
+	// Neither the files behind the symlinked dir nor the ones behind the symlinked parent are part of the backup
+	outsideDirPath := filepath.Join(filepath.Dir(backupDirPath), "outside")
+	outsideFilePath := filepath.Join(outsideDirPath, "victim.txt")
+	writeTestFile(t, outsideFilePath, "victim")
+
+	if err := os.Symlink(outsideDirPath, filepath.Join(backupDirPath, "app", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outsideDirPath, filepath.Join(backupDirPath, "escaped")); err != nil {
+		t.Fatal(err)
+	}
+
+	runBackup(t, cfg)
+
+	if got := readTestFile(t, outsideFilePath); got != "victim" {
+		t.Errorf("file outside the backup has %q, want it untouched", got)
+	}
+
+	if _, err := newBackupRun(cfg).resolveBackupPath(filepath.Join("escaped", "victim.txt")); err == nil {
+		t.Error("path through the symlink escaping the backup is resolved for removal")
+	}
+}
+
+func TestRunPrunesNestedEmptyDirs(t *testing.T) {
+	for _, keepEmptyDirs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep %t", keepEmptyDirs), func(t *testing.T) {
+			projectsDirPath, backupDirPath := newTestDirs(t)
+			projectPath := newProject(t, projectsDirPath, "app")
+
+			relPaths := []string{"a/b/c/deep.txt", "a/b/sibling.txt", "a/e/f.txt", "z/g/h/i/deeper.txt", "kept/notes.txt"}
+			for _, relPath := range relPaths {
+				writeTestFile(t, filepath.Join(projectPath, filepath.FromSlash(relPath)), relPath)
+			}
+
+			cfg := testConfig(projectsDirPath, backupDirPath)
+			cfg.KeepEmptyDirs = keepEmptyDirs
+			runBackup(t, cfg)
+
+			// Every dir is emptied only once its children are removed, so a parent pruned first would be left behind
+			for _, dirName := range []string{"a", "z"} {
+				if err := os.RemoveAll(filepath.Join(projectPath, dirName)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			runBackup(t, cfg)
+
+			for _, relPath := range []string{"app/a/b/c", "app/a/e", "app/z/g/h/i"} {
+				_, err := os.Stat(filepath.Join(backupDirPath, filepath.FromSlash(relPath)))
+				if keepEmptyDirs && err != nil {
+					t.Errorf("%s is pruned, want it kept: %v", relPath, err)
+				}
+				if !keepEmptyDirs && !os.IsNotExist(err) {
+					t.Errorf("%s is kept, want it pruned along with its parents (%v)", relPath, err)
+				}
+			}
+			if !keepEmptyDirs {
+				assertNotBackedUp(t, backupDirPath, "app/a")
+				assertNotBackedUp(t, backupDirPath, "app/z")
+			}
+
+			assertBackedUp(t, backupDirPath, "app/kept/notes.txt", "kept/notes.txt")
+		})
+	}
+}
+
+func TestRunFollowsSymlinkedProjects(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	rootPath := filepath.Dir(projectsDirPath)
+
+	// The real repos live elsewhere, linked both as a single project and as a whole projects dir
+	reposDirPath := filepath.Join(rootPath, "repos")
+	projectPath := newProject(t, reposDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+
+	if err := os.Symlink(projectPath, filepath.Join(projectsDirPath, "linked-app")); err != nil {
+		t.Fatal(err)
+	}
+
+	linkedProjectsDirPath := filepath.Join(rootPath, "linked-repos")
+	if err := os.Symlink(reposDirPath, linkedProjectsDirPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// A link back to a searched dir would loop forever in recursive mode
+	if err := os.Symlink(projectsDirPath, filepath.Join(projectsDirPath, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.ProjectsDirs = append(cfg.ProjectsDirs, linkedProjectsDirPath)
+	cfg.Recursive = true
+
+	runBackup(t, cfg)
+
+	assertBackedUp(t, backupDirPath, "linked-app/notes.txt", "notes")
+	assertBackedUp(t, backupDirPath, "app/notes.txt", "notes")
+	assertNotBackedUp(t, backupDirPath, "loop")
+}
+
+// removingWriter removes a file once an event line containing the trigger is written, so that a test can act in the middle of a run
+type removingWriter struct {
+	trigger string
+	path    string
+}
+
+func (w removingWriter) Write(line []byte) (int, error) {
+	if strings.Contains(string(line), w.trigger) {
+		os.Remove(w.path)
+	}
+
+	return len(line), nil
+}
+
+func TestRunSkipsFileDeletedDuringRun(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(projectPath, "b.txt"), "b")
+
+	// A single job copies the files in order, so "b.txt" is deleted after being listed but before being copied
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Jobs = 1
+	cfg.FailFast = true
+	cfg.Events = removingWriter{trigger: `"path":"app/a.txt"`, path: filepath.Join(projectPath, "b.txt")}
+
+	report := runBackup(t, cfg)
+
+	if report.FilesSkipped != 1 || report.Truncated {
+		t.Errorf("%d files are skipped and the run is truncated %t, want only the deleted file skipped", report.FilesSkipped, report.Truncated)
+	}
+	assertBackedUp(t, backupDirPath, "app/a.txt", "a")
+	assertNotBackedUp(t, backupDirPath, "app/b.txt")
+}
+
+func TestRunReportsUnreadableFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any file")
+	}
+
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+
+	unreadablePath := filepath.Join(projectPath, "secret.txt")
+	writeTestFile(t, unreadablePath, "secret")
+	if err := os.Chmod(unreadablePath, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(unreadablePath, 0644) })
+
+	report, err := Run(testConfig(projectsDirPath, backupDirPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure of a single file doesn't stop the others
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "secret.txt") || report.ProjectsFailed != 1 {
+		t.Errorf("%d projects failed with errors %q, want one about secret.txt", report.ProjectsFailed, report.Errors)
+	}
+	assertBackedUp(t, backupDirPath, "app/notes.txt", "notes")
+	assertNotBackedUp(t, backupDirPath, "app/secret.txt")
+}
+
+func TestIsFileChangedByCompareMode(t *testing.T) {
+	sameTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	laterTime := sameTime.Add(time.Hour)
+
+	pairs := []struct {
+		name          string
+		backupContent string
+		backupModTime time.Time
+		want          map[string]bool // Whether each compare mode detects a change
+	}{
+		{"touched", "content", laterTime, map[string]bool{compareModeHash: false, compareModeQuick: true, compareModeGit: false}},
+		{"edited", "CONTENT", laterTime, map[string]bool{compareModeHash: true, compareModeQuick: true, compareModeGit: true}},
+		{"resized", "content!", sameTime, map[string]bool{compareModeHash: true, compareModeQuick: true, compareModeGit: true}},
+
+		// The modification time and the size are trusted in every mode, so this change is only found by "--check"
+		{"edited in place", "CONTENT", sameTime, map[string]bool{compareModeHash: false, compareModeQuick: false, compareModeGit: false}},
+	}
+
+	for _, pair := range pairs {
+		dirPath := t.TempDir()
+		projectFilePath := filepath.Join(dirPath, "project.txt")
+		backupFilePath := filepath.Join(dirPath, "backup.txt")
+
+		writeTestFile(t, projectFilePath, "content")
+		writeTestFile(t, backupFilePath, pair.backupContent)
+
+		for path, modTime := range map[string]time.Time{projectFilePath: sameTime, backupFilePath: pair.backupModTime} {
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for compareMode, want := range pair.want {
+			run := newBackupRun(Config{CompareMode: compareMode, GitBinary: "git", Quiet: true})
+
+			isChanged, reason, err := run.isFileChanged(projectFilePath, backupFilePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isChanged != want {
+				t.Errorf("%s file is changed %t (%s) in %s mode, want %t", pair.name, isChanged, reason, compareMode, want)
+			}
+		}
+	}
+}
+
+func TestRunBacksUpProjectWithoutRemote(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+
+	// Nothing is pushed anywhere, so every committed file is only local
+	projectPath := filepath.Join(projectsDirPath, "local")
+	git(t, ".", "init", "--quiet", "--initial-branch=main", projectPath)
+	writeTestFile(t, filepath.Join(projectPath, "committed.txt"), "committed")
+	git(t, projectPath, "add", ".")
+	git(t, projectPath, "commit", "--quiet", "-m", "init")
+	writeTestFile(t, filepath.Join(projectPath, "untracked.txt"), "untracked")
+
+	// A project without any commit has nothing to diff, which isn't a failure either
+	emptyProjectPath := filepath.Join(projectsDirPath, "empty")
+	git(t, ".", "init", "--quiet", "--initial-branch=main", emptyProjectPath)
+	writeTestFile(t, filepath.Join(emptyProjectPath, "untracked.txt"), "untracked")
+
+	runBackup(t, testConfig(projectsDirPath, backupDirPath))
+
+	assertBackedUp(t, backupDirPath, "local/committed.txt", "committed")
+	assertBackedUp(t, backupDirPath, "local/untracked.txt", "untracked")
+	assertBackedUp(t, backupDirPath, "empty/untracked.txt", "untracked")
+}
+
+func TestRunBacksUpNewBranchSinceItForked(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	// Like after a plain `git remote add` and push, where the default branch of the remote isn't known
+	git(t, projectPath, "remote", "set-head", "origin", "--delete")
+
+	git(t, projectPath, "switch", "--quiet", "--create", "feature")
+	writeTestFile(t, filepath.Join(projectPath, "feature.txt"), "feature")
+	git(t, projectPath, "add", ".")
+	git(t, projectPath, "commit", "--quiet", "-m", "feature")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.IncludeCommitPatches = true
+	runBackup(t, cfg)
+
+	assertBackedUp(t, backupDirPath, "app/feature.txt", "feature")
+	assertNotBackedUp(t, backupDirPath, "app/README.md")
+
+	// Only the commit of the branch is unpushed, not the pushed history it forked from
+	patchEntries, err := os.ReadDir(filepath.Join(backupDirPath, "app", metadataDirName, "patches"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patchEntries) != 1 || !strings.HasSuffix(patchEntries[0].Name(), "-feature.patch") {
+		t.Errorf("patches are %v, want only the one of the feature commit", patchEntries)
+	}
+}
+
+func TestRunBacksUpRenamedFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		diffRenames string
+		commit      bool
+	}{
+		{"committed", "", true},
+		{"staged", "", false},
+		{"committed with copy detection", "copies", true},
+		{"staged with copy detection", "copies", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			projectsDirPath, backupDirPath := newTestDirs(t)
+			projectPath := newProject(t, projectsDirPath, "app")
+
+			// Without "--no-renames", a detected rename or copy would list only the new path
+			if test.diffRenames != "" {
+				git(t, projectPath, "config", "diff.renames", test.diffRenames)
+			}
+
+			writeTestFile(t, filepath.Join(projectPath, "old.txt"), "renamed")
+			git(t, projectPath, "add", ".")
+			git(t, projectPath, "commit", "--quiet", "-m", "add")
+
+			cfg := testConfig(projectsDirPath, backupDirPath)
+			runBackup(t, cfg)
+			assertBackedUp(t, backupDirPath, "app/old.txt", "renamed")
+
+			// Once pushed, the old path is in the diffs as deleted instead of never being there
+			git(t, projectPath, "push", "--quiet", "origin", "HEAD:main")
+			git(t, projectPath, "mv", "old.txt", "new.txt")
+			if test.commit {
+				git(t, projectPath, "commit", "--quiet", "-m", "rename")
+			}
+
+			// The old path is listed too, so its backup is removed like any deleted file without relying on the rename detection
+			listCfg := cfg
+			listCfg.GitBinary = "git"
+
+			changedFiles, err := newBackupRun(listCfg).listChangedFiles(project{name: "app", path: projectPath})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Contains(changedFiles, "old.txt") || !slices.Contains(changedFiles, "new.txt") {
+				t.Errorf("changed files are %q, want both the old and the new path", changedFiles)
+			}
+
+			runBackup(t, cfg)
+
+			assertBackedUp(t, backupDirPath, "app/new.txt", "renamed")
+			assertNotBackedUp(t, backupDirPath, "app/old.txt")
+		})
+	}
+}
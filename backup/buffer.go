@@ -0,0 +1,27 @@
+package backup
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize cuts down the read and write calls of large files compared to the 32KB default of [io.Copy]
+const copyBufferSize = 1 << 20
+
+// copyBufferPool reuses the copy buffers across the files and the jobs.
+// Only the buffers in use are kept alive between garbage collections, which are at most one per job.
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, copyBufferSize)
+		return &buffer
+	},
+}
+
+// copyBuffered copies like [io.Copy] through a pooled buffer
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buffer)
+
+	// A file source would copy itself via its WriteTo with the default buffer, so only its Read is exposed
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, *buffer)
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkCopyLargeFile compares copying a large file through the pooled buffer with the default buffer of [io.Copy]
+func BenchmarkCopyLargeFile(b *testing.B) {
+	const fileSize = 256 << 20
+
+	dirPath := b.TempDir()
+	srcPath := filepath.Join(dirPath, "large.bin")
+
+	content := make([]byte, fileSize)
+	rand.Read(content)
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	copies := map[string]func(dst io.Writer, src io.Reader) (int64, error){
+		"pooled buffer": copyBuffered,
+		"io.Copy":       func(dst io.Writer, src io.Reader) (int64, error) { return io.Copy(dst, struct{ io.Reader }{src}) },
+	}
+
+	for name, copyFunc := range copies {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(fileSize)
+
+			for range b.N {
+				copyWith(b, copyFunc, srcPath, filepath.Join(dirPath, "copy.bin"))
+			}
+		})
+	}
+
+	// The whole copy path, including the temporary file and the digest
+	b.Run("copyFile", func(b *testing.B) {
+		b.SetBytes(fileSize)
+
+		run := newBackupRun(Config{Quiet: true})
+		for range b.N {
+			if _, err := run.copyFile(srcPath, filepath.Join(dirPath, "backup", "large.bin")); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// copyWith copies the source file into the destination file via the copy function
+func copyWith(b *testing.B, copyFunc func(dst io.Writer, src io.Reader) (int64, error), srcPath, dstPath string) {
+	b.Helper()
+
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dstPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dstFile.Close()
+
+	if _, err := copyFunc(dstFile, srcFile); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isCaseInsensitiveDir reports whether the filesystem of the dir treats the names differing only by case as the same file,
+// like the default filesystems of macOS and Windows.
+// An entry of the dir is looked up by its case-swapped name. An empty dir is probed with a temporary file,
+// except in a dry run, where it's assumed to be case-sensitive.
+func (run *backupRun) isCaseInsensitiveDir(dirPath string) (bool, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		if isCaseInsensitive, ok := isSameFileInOtherCase(filepath.Join(dirPath, entry.Name())); ok {
+			return isCaseInsensitive, nil
+		}
+	}
+
+	if run.config.DryRun {
+		return false, nil
+	}
+
+	probe, err := os.CreateTemp(dirPath, ".git-backup-case-probe-*")
+	if err != nil {
+		return false, err
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	isCaseInsensitive, _ := isSameFileInOtherCase(probe.Name())
+
+	return isCaseInsensitive, nil
+}
+
+// isSameFileInOtherCase reports whether the path with its name in a different case refers to the same file.
+// It isn't ok if the name has no letters with a case or the file can't be read.
+func isSameFileInOtherCase(path string) (isSame, ok bool) {
+	name := filepath.Base(path)
+
+	otherCaseName := strings.ToUpper(name)
+	if otherCaseName == name {
+		otherCaseName = strings.ToLower(name)
+	}
+	if otherCaseName == name {
+		return false, false
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, false
+	}
+
+	otherCaseInfo, err := os.Lstat(filepath.Join(filepath.Dir(path), otherCaseName))
+	if os.IsNotExist(err) {
+		return false, true
+	}
+	if err != nil {
+		return false, false
+	}
+
+	return os.SameFile(info, otherCaseInfo), true
+}
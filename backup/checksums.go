@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// checksumsFileName is the file in the backup root that lists the digests of the backed up files via "--checksums",
+// in the format of "sha256sum", so that the backup can be verified with "sha256sum -c SHA256SUMS" from the backup dir
+const checksumsFileName = "SHA256SUMS"
+
+// writeChecksums atomically replaces the checksums file with the digests recorded in the manifest.
+// The digests are computed while copying, so the unchanged files keep theirs without being read again.
+func (run *backupRun) writeChecksums(path string, m manifest) error {
+	content := strings.Builder{}
+
+	for _, relPath := range slices.Sorted(maps.Keys(m)) {
+		slashPath := filepath.ToSlash(relPath)
+
+		// Like sha256sum, a line with a backslash or a new line in its path is escaped and starts with a backslash
+		if strings.ContainsAny(slashPath, "\\\n") {
+			content.WriteByte('\\')
+			slashPath = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(slashPath)
+		}
+
+		content.WriteString(m[relPath].Hash + "  " + slashPath + "\n")
+	}
+
+	_, err := run.writeFile(path, strings.NewReader(content.String()), nil)
+
+	return err
+}
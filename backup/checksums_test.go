@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumsOfFileModifiedDuringCopy(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	filePath := filepath.Join(projectPath, "data.bin")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Checksums = true
+
+	writeTestFile(t, filePath, "old")
+	runBackup(t, cfg)
+
+	newContent := strings.Repeat("new", 8<<20)
+	writeTestFile(t, filePath, newContent)
+	runWhileModifying(t, cfg, filePath)
+
+	// "sha256sum -c" would fail on the digest of the previous content
+	want := sha256Hex(newContent) + "  app/data.bin\n"
+	if got := readTestFile(t, filepath.Join(backupDirPath, checksumsFileName)); !strings.Contains(got, want) {
+		t.Errorf("%s is %q, want it to list %q", checksumsFileName, got, want)
+	}
+
+	assertBackedUp(t, backupDirPath, "app/data.bin", newContent)
+}
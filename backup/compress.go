@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"os"
+	"strings"
+)
+
+// compressedFileExt is appended to the backup path of every file compressed via "--compress"
+const compressedFileExt = ".gz"
+
+// isCompressed reports whether a backup file is stored compressed.
+// Symlinks are never compressed, so the path is only a hint for regular files.
+func (run *backupRun) isCompressed(backupFilePath string) bool {
+	return run.config.Compress != "" && strings.HasSuffix(backupFilePath, compressedFileExt)
+}
+
+// shouldCompress reports whether a project file is backed up compressed. Symlinks are recreated as links, so there's nothing to compress.
+// The files below "--compress-min-size" are stored raw, except the ones already named like a compressed file,
+// as restoring would take them for compressed ones.
+func (run *backupRun) shouldCompress(relPath string, info os.FileInfo) bool {
+	if run.config.Compress == "" || isSymlink(info) {
+		return false
+	}
+
+	return info.Size() >= run.config.CompressMinSize || strings.HasSuffix(relPath, compressedFileExt)
+}
+
+// compressFile writes a gzip compressed copy of the source file, preserving its permissions and times.
+// It returns the SHA-256 digest of the uncompressed content, so it's comparable with the source file.
+func (run *backupRun) compressFile(srcPath, dstPath string, srcInfo os.FileInfo) ([]byte, error) {
+	sourceFile, err := os.Open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer sourceFile.Close()
+
+	sourceHash := sha256.New()
+	compressedReader, compressedWriter := io.Pipe()
+
+	go func() {
+		gzipWriter := gzip.NewWriter(compressedWriter)
+
+		_, err := copyBuffered(gzipWriter, io.TeeReader(sourceFile, sourceHash))
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+
+		compressedWriter.CloseWithError(err)
+	}()
+
+	_, err = run.writeFile(dstPath, compressedReader, srcInfo)
+
+	// Unblocks the compression if the write has failed midway
+	compressedReader.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sourceHash.Sum(nil), nil
+}
+
+// decompressFile writes the uncompressed content of a compressed backup file, preserving its permissions and times
+func (run *backupRun) decompressFile(srcPath, dstPath string) error {
+	srcInfo, err := os.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	compressedFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer compressedFile.Close()
+
+	gzipReader, err := gzip.NewReader(compressedFile)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	_, err = run.writeFile(dstPath, gzipReader, srcInfo)
+
+	return err
+}
+
+// hashBackupFile returns the SHA-256 digest of a backup file's content, decompressing it first if it's compressed
+// or taking it from the object it points to in dedup mode
+func (run *backupRun) hashBackupFile(backupFilePath string) ([]byte, error) {
+	// An object is named after the digest of its content
+	if objectHash, err := readObjectPointer(backupFilePath); err != nil || objectHash != nil {
+		// A pointer to a removed object has nothing to restore, so it never matches and the file is copied again
+		if err == nil {
+			if _, err := os.Stat(run.objectPath(objectHash)); os.IsNotExist(err) {
+				return nil, nil
+			}
+		}
+
+		return objectHash, err
+	}
+
+	if !run.isCompressed(backupFilePath) {
+		return hashFile(backupFilePath)
+	}
+
+	compressedFile, err := os.Open(backupFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer compressedFile.Close()
+
+	gzipReader, err := gzip.NewReader(compressedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, gzipReader); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	files := map[string]string{
+		"notes.txt":         "notes",
+		"nested/data.json":  strings.Repeat(`{"key": "value"}`, 1000),
+		"empty.txt":         "",
+		"already.tar.gz":    "named like a compressed file",
+		"nested/binary.bin": "\x00\x01\x02\xff",
+	}
+	for relPath, content := range files {
+		writeTestFile(t, filepath.Join(projectPath, filepath.FromSlash(relPath)), content)
+	}
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Compress = "gzip"
+	runBackup(t, cfg)
+
+	for relPath := range files {
+		assertNotBackedUp(t, backupDirPath, "app/"+relPath)
+	}
+
+	// The compressed backups are compared with the sources by their uncompressed content
+	if report := runBackup(t, cfg); report.FilesCopied != 0 || report.FilesUpdated != 0 {
+		t.Errorf("%d files are copied and %d updated without a change, want none", report.FilesCopied, report.FilesUpdated)
+	}
+
+	restoreCfg := restoreConfig(t, cfg)
+	report, err := Restore(restoreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) > 0 || report.FilesRestored != len(files) {
+		t.Fatalf("%d files are restored with errors %q, want %d", report.FilesRestored, report.Errors, len(files))
+	}
+
+	for relPath, content := range files {
+		if got := readTestFile(t, filepath.Join(restoreCfg.ProjectsDirs[0], "app", filepath.FromSlash(relPath))); got != content {
+			t.Errorf("%s is restored with %q, want %q", relPath, got, content)
+		}
+	}
+}
+
+func TestCompressMinSizeRoundTrip(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+
+	small, large := "small", strings.Repeat("large", 1000)
+	writeTestFile(t, filepath.Join(projectPath, "small.txt"), small)
+	writeTestFile(t, filepath.Join(projectPath, "large.txt"), large)
+	writeTestFile(t, filepath.Join(projectPath, "growing.txt"), small)
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Compress = "gzip"
+	cfg.CompressMinSize = 1024
+	runBackup(t, cfg)
+
+	// The small files are stored as is next to the compressed large ones
+	assertBackedUp(t, backupDirPath, "app/small.txt", small)
+	assertNotBackedUp(t, backupDirPath, "app/large.txt")
+	if _, err := os.Stat(filepath.Join(backupDirPath, "app", "large.txt"+compressedFileExt)); err != nil {
+		t.Error(err)
+	}
+
+	// A file crossing the threshold is stored compressed, and its raw backup is removed as stale
+	writeTestFile(t, filepath.Join(projectPath, "growing.txt"), large)
+	runBackup(t, cfg)
+
+	assertNotBackedUp(t, backupDirPath, "app/growing.txt")
+
+	restoreCfg := restoreConfig(t, cfg)
+	report, err := Restore(restoreCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) > 0 || report.FilesRestored != 3 {
+		t.Fatalf("%d files are restored with errors %q, want 3", report.FilesRestored, report.Errors)
+	}
+
+	for relPath, content := range map[string]string{"small.txt": small, "large.txt": large, "growing.txt": large} {
+		if got := readTestFile(t, filepath.Join(restoreCfg.ProjectsDirs[0], "app", relPath)); got != content {
+			t.Errorf("%s is restored with %d bytes, want %d", relPath, len(got), len(content))
+		}
+	}
+}
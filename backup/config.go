@@ -0,0 +1,289 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config controls what gets backed up and how. The zero value of an option disables it,
+// except for the untracked, unstaged, staged and unpushed categories, which are usually all enabled.
+type Config struct {
+	ProjectsDirs []string // Directories containing the git projects (required unless ProjectPaths or PlainDirs is given)
+	ProjectPaths []string // Individual git projects to back up under their dir names, like the ones outside the projects dirs
+	BackupDir    string   // Directory to back up the projects into (required unless Archive is given)
+	Archive      string   // Tar archive to write the projects into instead of the backup dir, gzip compressed if it ends with ".gz" or ".tgz"
+	Remote       string   // Remote the branches without an upstream are compared with, like "origin", unless the project lacks it
+	GitBinary    string   // Path of the git executable, looked up in PATH if it's only a name like the default "git"
+
+	PlainDirs       []string // Directories without git to back up every file of, like notes, bypassing the git logic
+	PlainDirsPrefix string   // Backup dir that the plain dirs are backed up into under their dir names, the backup root if empty
+
+	Recursive       bool     // Search for git projects in the nested directories of the projects dirs
+	WarnNonGitDirs  bool     // Warn about the dirs of the projects dirs that aren't git projects, instead of only listing them in verbose mode
+	Projects        []string // Only back up the projects with these names, if any
+	ExcludeProjects []string // Skip the projects matching these glob patterns
+
+	Untracked         bool // Back up the files that are not yet tracked by git
+	UntrackedIgnored  bool // Back up the untracked files ignored by ".gitignore", ".git/info/exclude" and the global excludes too
+	Unstaged          bool // Back up the working tree changes that are not yet staged
+	Staged            bool // Back up the staged changes that are not yet committed
+	Unpushed          bool // Back up the files changed in the local commits that are not yet pushed
+	IncludeSubmodules bool // Back up the changes of the submodules recursively
+
+	ForceInclude          []string // Git ignored files or directories to always include, like ".git" or "**/.env"
+	ForceIncludeGitignore bool     // Skip the git ignored files inside the force-included directories
+	CopyEmptyDirs         bool     // Create the empty dirs inside the force-included directories in the backup and never prune them
+	Exclude               []string // Never back up the files matching these glob patterns
+
+	IncludeIgnored []string // Back up the git ignored files matching these glob patterns, like "*.local.json"
+
+	IncludeStashes       bool     // Export the stashes as patch files
+	IncludeCommitPatches bool     // Export the unpushed commits as patch files
+	AllBranches          bool     // Export the unpushed commits of the other local branches as patch files
+	IncludeTags          bool     // Export the tags pointing to the commits that aren't on any remote
+	GitSubpaths          []string // Files or directories inside the git dir to back up, like "config" or "hooks"
+
+	MaxFileSize  int64         // Skip the files larger than this many bytes, if positive
+	MaxTotalSize int64         // Leave out the oldest files that don't fit in this many bytes in total, if positive
+	Since        time.Duration // Only copy the files modified within this duration, if positive
+
+	// Skip scanning the projects with no file modified since their last backup, which is recorded in the manifest.
+	// Changing the other options doesn't affect the skipped projects until one of their files is modified.
+	NewerThanBackup bool
+
+	TimeBudget time.Duration   // Stop scanning new projects and copying new files after this duration, if positive
+	FailFast   bool            // Stop scanning new projects, copying new files and removing files after the first error
+	Stop       <-chan struct{} // Stop scanning new projects, copying new files and removing files once closed, like on an interrupt
+
+	Jobs                  int    // Number of projects to scan and files to copy concurrently
+	RateLimit             int64  // Limit the total copy throughput to this many bytes per second, if positive
+	Compress              string // Compress the backed up files with this algorithm. Only "gzip" is supported.
+	CompressMinSize       int64  // Store the files smaller than this many bytes uncompressed, as compressing them saves little
+	SanitizeNames         bool   // Replace the characters in the backup paths that are invalid on Windows filesystems
+	Flatten               bool   // Back up the project files directly in the backup dir, named like "project__path__to__file"
+	Layout                string // Top-level backup dirs of the projects: "project-name" (default), "remote-name" or "source-path"
+	CaseInsensitiveTarget bool   // Treat the backup filesystem as case-insensitive without detecting it
+	Hardlink              bool   // Hardlink the files into the backup instead of copying them, if possible
+	Dedup                 bool   // Store each distinct file content once in the backup dir and hardlink or point the backed up files to it
+	Fsync                 bool   // Flush every copied file to the disk
+	Verify                bool   // Re-read every copied file and compare its checksum with the source
+	Checksums             bool   // Write the digests of the backed up files into "SHA256SUMS" of the backup dir on each run
+	CompareMode           string // How the files with a different modification time are compared: "hash" (default), "quick" or "git"
+
+	OverwriteOnlyIfNewer bool // Keep the backed up files modified after their source, like ones edited in the backup directly
+	Retries              int  // Retry the transient copy failures this many times with an exponential backoff
+
+	TrashDir       string        // Move the removed files into this directory instead of deleting them
+	TrashRetention time.Duration // Delete the trash folders older than this duration
+	RemovalLog     bool          // Record the removed files in the backup dir
+	KeepEmptyDirs  bool          // Keep the backup dirs that became empty after removing the files, instead of pruning them
+
+	KeepRemovedFiles bool // Never remove the files no longer in the projects or prune any dir, making the backup append-only
+
+	DryRun      bool // Preview the changes without modifying anything
+	Check       bool // Compare the backup with the project files by their content without modifying anything. Implies DryRun.
+	Force       bool // Overwrite the existing project files while restoring
+	ForceUnlock bool // Run even if the backup dir is locked by another run
+
+	RequireBackupDir bool // Fail if the backup dir doesn't exist instead of creating it
+
+	OutputFormat  string // How a dry run lists the planned changes: "flat" line by line (default) or "tree" grouped by directory
+	ShowDiffLines int    // Print up to this many lines of the diff of each changed file in a flat dry run, if positive
+
+	Verbose  bool // Print every file that is copied, skipped or removed along with the reason
+	Quiet    bool // Print only the errors
+	Progress bool // Show the progress of the copied bytes on stderr
+
+	Events io.Writer // Stream every step of the run as a JSON line, like to a file or a pipe
+	Log    io.Writer // Write every output line with a timestamp and a level, like "INFO", "WARN" or "ERROR", regardless of the verbosity
+
+	// Called with the backup paths of the files no longer in the projects before they are removed, if set.
+	// Returning false keeps them in the backup for this run.
+	ConfirmRemovals func(relPaths []string) bool
+}
+
+// backupRun is the state of a single [Run] or [Restore]. Nothing is shared between the runs, so an embedding program can run
+// multiple backups concurrently, as long as they don't write into the same backup dir, which the lock file guards against.
+type backupRun struct {
+	config Config
+
+	// Manifest of the previous run. It's only read while the files are being copied.
+	backupManifest manifest
+
+	// When each project was last backed up, keyed by the project name
+	backupProjectStates projectStates
+
+	// Tracks the bytes processed during the copy phase. It's nil unless "--progress" is set.
+	copyProgress *progress
+
+	// Throttles the bytes written by all the copy workers together. It's nil unless "--rate-limit" is set.
+	copyRateLimiter *rateLimiter
+
+	// Keeps the lines of the events emitted by the concurrent workers from interleaving
+	eventMutex sync.Mutex
+}
+
+func newBackupRun(cfg Config) *backupRun {
+	return &backupRun{config: cfg, backupManifest: manifest{}, backupProjectStates: projectStates{}}
+}
+
+// ErrInvalidConfig is wrapped by the errors of the options that are missing or can't be combined
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Validate reports the first option that is missing or can't be combined, wrapping [ErrInvalidConfig].
+// [Run] and [Restore] validate the config themselves, so it's only needed to reject a config before doing anything else.
+func (cfg Config) Validate() error {
+	// The paths are normalized in place, which must not change the slices of the caller
+	cfg.ProjectPaths = slices.Clone(cfg.ProjectPaths)
+	cfg.PlainDirs = slices.Clone(cfg.PlainDirs)
+	cfg.GitSubpaths = slices.Clone(cfg.GitSubpaths)
+
+	return cfg.validate()
+}
+
+// validate checks the required options and normalizes the paths
+func (cfg *Config) validate() (err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+	}()
+
+	if len(cfg.ProjectsDirs) == 0 && len(cfg.ProjectPaths) == 0 && len(cfg.PlainDirs) == 0 {
+		return errors.New("no projects directory, project or plain directory is given")
+	}
+
+	// Cleaned, so that a trailing separator doesn't leave the project without a name
+	for i, projectPath := range cfg.ProjectPaths {
+		cfg.ProjectPaths[i] = filepath.Clean(projectPath)
+	}
+	for i, plainDirPath := range cfg.PlainDirs {
+		cfg.PlainDirs[i] = filepath.Clean(plainDirPath)
+	}
+
+	if cfg.PlainDirsPrefix != "" && !filepath.IsLocal(cfg.PlainDirsPrefix) {
+		return fmt.Errorf("plain directories prefix %s must be a relative path inside the backup directory", cfg.PlainDirsPrefix)
+	}
+
+	if cfg.BackupDir == "" && cfg.Archive == "" {
+		return errors.New("no backup directory or archive is given")
+	}
+
+	if cfg.BackupDir != "" && cfg.Archive != "" {
+		return errors.New("only one of the backup directory and the archive can be given")
+	}
+
+	// A fresh archive is written on each run, so there's no existing backup to compare with
+	if cfg.Archive != "" && cfg.Check {
+		return errors.New("an archive can't be checked")
+	}
+
+	// A partial archive would replace the previous complete one, so the run can't be cut short
+	if cfg.Archive != "" && cfg.TimeBudget > 0 {
+		return errors.New("time budget can't be combined with an archive")
+	}
+
+	// The files are streamed into the archive as they're found, so the most recent ones can't be picked first
+	if cfg.Archive != "" && cfg.MaxTotalSize > 0 {
+		return errors.New("max total size can't be combined with an archive")
+	}
+
+	// The archive is a plain tar stream written from scratch, so the options about the files of a backup dir would do nothing
+	if cfg.Archive != "" {
+		backupDirOptions := []struct {
+			name  string
+			isSet bool
+		}{
+			{"compression", cfg.Compress != ""},
+			{"dedup", cfg.Dedup},
+			{"hardlink", cfg.Hardlink},
+			{"checksums", cfg.Checksums},
+			{"verify", cfg.Verify},
+			{"trash dir", cfg.TrashDir != ""},
+			{"removal log", cfg.RemovalLog},
+			{"keeping the removed files", cfg.KeepRemovedFiles},
+			{"flatten", cfg.Flatten},
+			{"sanitize names", cfg.SanitizeNames},
+		}
+
+		for _, option := range backupDirOptions {
+			if option.isSet {
+				return fmt.Errorf("%s can't be combined with an archive", option.name)
+			}
+		}
+	}
+
+	if cfg.Jobs < 1 {
+		return fmt.Errorf("number of jobs must be at least 1, got %d", cfg.Jobs)
+	}
+
+	if cfg.Retries < 0 {
+		return fmt.Errorf("number of retries can't be negative, got %d", cfg.Retries)
+	}
+
+	if cfg.Verbose && cfg.Quiet {
+		return errors.New("verbose and quiet can't be combined")
+	}
+
+	if cfg.CompareMode != "" && cfg.CompareMode != compareModeHash && cfg.CompareMode != compareModeQuick && cfg.CompareMode != compareModeGit {
+		return fmt.Errorf("unsupported compare mode %q", cfg.CompareMode)
+	}
+
+	if cfg.Compress != "" && cfg.Compress != "gzip" {
+		return fmt.Errorf("unsupported compression %q", cfg.Compress)
+	}
+
+	if cfg.Layout != "" && cfg.Layout != layoutProjectName && cfg.Layout != layoutRemoteName && cfg.Layout != layoutSourcePath {
+		return fmt.Errorf("unsupported layout %q", cfg.Layout)
+	}
+
+	if cfg.OutputFormat != "" && cfg.OutputFormat != "flat" && cfg.OutputFormat != "tree" {
+		return fmt.Errorf("unsupported output format %q", cfg.OutputFormat)
+	}
+
+	// The recorded digests are of the original content, which a compressed file doesn't have
+	if cfg.Checksums && cfg.Compress != "" {
+		return errors.New("checksums can't be combined with compression")
+	}
+
+	if cfg.Dedup && (cfg.Compress != "" || cfg.Hardlink) {
+		return errors.New("dedup can't be combined with compression or hardlinking")
+	}
+
+	for i, subpath := range cfg.GitSubpaths {
+		subpath = filepath.Clean(subpath)
+		subpath = strings.TrimPrefix(subpath, ".git"+string(filepath.Separator))
+
+		isObjectDatabase := subpath == "objects" || strings.HasPrefix(subpath, "objects"+string(filepath.Separator))
+		if !filepath.IsLocal(subpath) || subpath == "." || subpath == ".git" || isObjectDatabase {
+			return fmt.Errorf("invalid git subpath %q, it must be a path inside the git dir other than the objects", cfg.GitSubpaths[i])
+		}
+
+		cfg.GitSubpaths[i] = subpath
+	}
+
+	if cfg.Check {
+		cfg.DryRun = true
+	}
+
+	if cfg.Remote == "" {
+		cfg.Remote = "origin"
+	}
+
+	if cfg.GitBinary == "" {
+		cfg.GitBinary = "git"
+	}
+
+	// Cleaned to be compared with the paths found while walking the backup dir
+	if cfg.TrashDir != "" {
+		cfg.TrashDir = filepath.Clean(cfg.TrashDir)
+	}
+
+	return nil
+}
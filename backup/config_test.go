@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRejectsArchiveCombinations(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   string
+	}{
+		{"time budget", func(cfg *Config) { cfg.TimeBudget = time.Minute }, "time budget"},
+		{"max total size", func(cfg *Config) { cfg.MaxTotalSize = 1 << 30 }, "max total size"},
+		{"compression", func(cfg *Config) { cfg.Compress = "gzip" }, "compression"},
+		{"dedup", func(cfg *Config) { cfg.Dedup = true }, "dedup"},
+		{"hardlink", func(cfg *Config) { cfg.Hardlink = true }, "hardlink"},
+		{"checksums", func(cfg *Config) { cfg.Checksums = true }, "checksums"},
+		{"verify", func(cfg *Config) { cfg.Verify = true }, "verify"},
+		{"trash dir", func(cfg *Config) { cfg.TrashDir = "trash" }, "trash dir"},
+		{"removal log", func(cfg *Config) { cfg.RemovalLog = true }, "removal log"},
+		{"keep removed files", func(cfg *Config) { cfg.KeepRemovedFiles = true }, "keeping the removed files"},
+		{"flatten", func(cfg *Config) { cfg.Flatten = true }, "flatten"},
+		{"sanitize names", func(cfg *Config) { cfg.SanitizeNames = true }, "sanitize names"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t.TempDir(), "")
+			cfg.Archive = "backup.tar"
+			test.modify(&cfg)
+
+			if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("validate returned %v, want an error about the %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := testConfig(t.TempDir(), t.TempDir())
+	cfg.Verbose = true
+
+	if err := cfg.Validate(); !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "verbose and quiet") {
+		t.Errorf("Validate returned %v, want an invalid config error about verbose and quiet", err)
+	}
+
+	cfg.Verbose = false
+	cfg.GitSubpaths = []string{filepath.Join(".git", "hooks")}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(".git", "hooks"); cfg.GitSubpaths[0] != want {
+		t.Errorf("git subpath of the caller is changed to %s, want %s", cfg.GitSubpaths[0], want)
+	}
+}
@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// objectsDirName is the directory in the backup root that stores each distinct file content once in "--dedup" mode
+const objectsDirName = ".git-backup-objects"
+
+// objectPointerPrefix starts a pointer file, which stands in for a backed up file when the object can't be hardlinked.
+// The rest of the pointer is the hex digest of the object, followed by a new line.
+const objectPointerPrefix = "git-local-backup object sha256:"
+
+var objectPointerSize = int64(len(objectPointerPrefix) + hex.EncodedLen(sha256.Size) + 1)
+
+// objectPath returns the path of the object with the content of the digest.
+// The objects are spread into subdirectories by the first byte of their digest, so that no directory grows too large.
+func (run *backupRun) objectPath(hash []byte) string {
+	hexHash := hex.EncodeToString(hash)
+
+	return filepath.Join(run.config.BackupDir, objectsDirName, hexHash[:2], hexHash)
+}
+
+// dedupFile stores the content of the source file in the object store unless it's already there,
+// then hardlinks the destination to the object. If the filesystem doesn't support hardlinks, a pointer file is written instead.
+// It returns the SHA-256 digest of the source file.
+//
+// The hardlinked copies of the same content share the permissions and times of the first copy.
+func (run *backupRun) dedupFile(srcPath, dstPath string, srcInfo fs.FileInfo) ([]byte, error) {
+	hash, err := hashFile(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	objectFilePath := run.objectPath(hash)
+
+	_, err = os.Stat(objectFilePath)
+	if os.IsNotExist(err) {
+		sourceFile, err := os.Open(srcPath)
+		if err != nil {
+			return nil, err
+		}
+		defer sourceFile.Close()
+
+		writtenHash, err := run.writeFile(objectFilePath, sourceFile, srcInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		// An object must never have a content other than its name says
+		if !bytes.Equal(writtenHash, hash) {
+			os.Remove(objectFilePath)
+			return nil, fmt.Errorf("%s was modified while being copied", srcPath)
+		}
+	} else if err != nil {
+		return nil, err
+	} else if run.copyProgress != nil {
+		run.copyProgress.add(srcInfo.Size())
+	}
+
+	if err := linkFile(objectFilePath, dstPath); err == nil {
+		return hash, nil
+	}
+
+	pointer := objectPointerPrefix + hex.EncodeToString(hash) + "\n"
+	if _, err := run.writeFile(dstPath, strings.NewReader(pointer), nil); err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+// readObjectPointer returns the digest of the object that the backup file points to.
+// It's nil if the file isn't a pointer.
+func readObjectPointer(backupFilePath string) ([]byte, error) {
+	info, err := os.Lstat(backupFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the files of the exact size are read, so the regular backup files cost a single stat
+	if !info.Mode().IsRegular() || info.Size() != objectPointerSize {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(backupFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	hexHash, isPointer := strings.CutPrefix(strings.TrimSuffix(string(content), "\n"), objectPointerPrefix)
+	if !isPointer {
+		return nil, nil
+	}
+
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil {
+		return nil, nil
+	}
+
+	return hash, nil
+}
+
+// removeUnusedObjects removes the objects whose content isn't recorded for any backed up file in the manifest anymore
+func (run *backupRun) removeUnusedObjects() error {
+	objectsDirPath := filepath.Join(run.config.BackupDir, objectsDirName)
+
+	if _, err := os.Stat(objectsDirPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	usedHashes := make(map[string]struct{}, len(run.backupManifest))
+	for _, entry := range run.backupManifest {
+		usedHashes[entry.Hash] = struct{}{}
+	}
+
+	return filepath.WalkDir(objectsDirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		// Leftover temporary files of a killed run aren't named after a digest either
+		if _, isUsed := usedHashes[entry.Name()]; isUsed {
+			return nil
+		}
+
+		objectRelPath, err := filepath.Rel(run.config.BackupDir, path)
+		if err != nil {
+			return err
+		}
+
+		run.logVerbose("-", objectRelPath, "(unused object)")
+
+		return os.Remove(path)
+	})
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// binaryProbeSize is how much of a file is searched for a NUL byte to tell binaries from text, the same as git does
+const binaryProbeSize = 8000
+
+// printDiff prints the first lines of the unified diff between the backed up file and its changed project file via "--show-diff".
+// The diff is made by git, so it's the same as the users are used to.
+// Binaries would only be reported as differing by git, so they are detected upfront to skip running it on large files.
+// Compressed backups have nothing to compare with as is, so they are left out.
+func (run *backupRun) printDiff(backupFileRelPath, projectFilePath string) {
+	if run.isCompressed(backupFileRelPath) {
+		return
+	}
+
+	backupFilePath := filepath.Join(run.config.BackupDir, backupFileRelPath)
+
+	objectHash, err := readObjectPointer(backupFilePath)
+	if err != nil {
+		run.logWarning("Failed to show the diff of", backupFileRelPath+":", err)
+		return
+	}
+	if objectHash != nil {
+		backupFilePath = run.objectPath(objectHash)
+	}
+
+	isBinary, err := isBinaryFile(projectFilePath)
+	if err == nil && !isBinary {
+		isBinary, err = isBinaryFile(backupFilePath)
+	}
+	if err != nil {
+		run.logWarning("Failed to show the diff of", backupFileRelPath+":", err)
+		return
+	}
+	if isBinary {
+		run.logVerbose("x", backupFileRelPath, "(binary, not diffed)")
+		run.logInfo("    Binary files differ")
+		return
+	}
+
+	// Exit code 1 only means that the files differ
+	stdout, err := run.gitCommand("", "diff", "--no-index", "--no-color", "--no-ext-diff", "--", backupFilePath, projectFilePath).Output()
+	if exitErr, ok := err.(*exec.ExitError); err != nil && !(ok && exitErr.ExitCode() == 1) {
+		run.logWarning("Failed to show the diff of", backupFileRelPath+":", err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(stdout), "\n"), "\n")
+	if len(lines) > run.config.ShowDiffLines {
+		hiddenCount := len(lines) - run.config.ShowDiffLines
+		lines = append(lines[:run.config.ShowDiffLines], fmt.Sprintf("… %d more lines", hiddenCount))
+	}
+
+	for _, line := range lines {
+		run.logInfo("    " + line)
+	}
+}
+
+// isBinaryFile reports whether the file has a NUL byte near its start, which text files never have
+func isBinaryFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	probe := make([]byte, binaryProbeSize)
+	n, err := io.ReadFull(file, probe)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+
+	return bytes.IndexByte(probe[:n], 0) >= 0, nil
+}
+
+// isGitDiffChanged reports whether git finds any difference between the project file and its backup, via "--compare-mode git"
+func (run *backupRun) isGitDiffChanged(projectFilePath, backupFilePath string) (bool, error) {
+	err := run.gitCommand("", "diff", "--no-index", "--quiet", "--no-ext-diff", "--", backupFilePath, projectFilePath).Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+)
+
+// Types of the events streamed to [Config.Events]
+const (
+	EventScanStart   = "scan-start"   // A project started being scanned for the changed files
+	EventFileCopied  = "file-copied"  // A file was copied into the backup, or would be in a dry run
+	EventFileRemoved = "file-removed" // A file was removed from the backup, or would be in a dry run
+	EventProjectDone = "project-done" // Every file of a project was processed
+	EventRunComplete = "run-complete" // The run finished, carrying the final report
+)
+
+// Event is a single step of a run. It's written as a JSON line to [Config.Events] as soon as it happens,
+// so that a supervising process can follow a long run live.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Project string    `json:"project,omitempty"`
+	Path    string    `json:"path,omitempty"` // Project dir for the project events, backup relative path for the file events
+	Error   string    `json:"error,omitempty"`
+	Report  *Report   `json:"report,omitempty"` // Only set for the run-complete event
+}
+
+// emitEvent timestamps the event and writes it as a single JSON line, if an event stream is configured.
+// A broken stream doesn't fail the backup itself, so the write errors are ignored.
+func (run *backupRun) emitEvent(event Event) {
+	if run.config.Events == nil {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Path = filepath.ToSlash(event.Path)
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	run.eventMutex.Lock()
+	defer run.eventMutex.Unlock()
+
+	run.config.Events.Write(append(line, '\n'))
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain isolates git from the config of the machine, like a global excludes file or a default branch name,
+// so that the projects made by the tests behave the same everywhere
+func TestMain(m *testing.M) {
+	os.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	os.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	os.Setenv("GIT_AUTHOR_NAME", "Test")
+	os.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	os.Setenv("GIT_COMMITTER_NAME", "Test")
+	os.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	os.Exit(m.Run())
+}
+
+// git runs a git command in the dir and returns its trimmed output, failing the test if it fails
+func git(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+
+	output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// newProject creates a git project with a pushed "README.md" in the projects dir, cloned from a bare remote next to it,
+// so that only the files the test adds or changes afterwards are backed up
+func newProject(t testing.TB, projectsDirPath, name string) string {
+	t.Helper()
+
+	remotePath := filepath.Join(filepath.Dir(projectsDirPath), "remotes", name+".git")
+	projectPath := filepath.Join(projectsDirPath, name)
+
+	git(t, ".", "init", "--quiet", "--bare", "--initial-branch=main", remotePath)
+	git(t, ".", "clone", "--quiet", remotePath, projectPath)
+
+	writeTestFile(t, filepath.Join(projectPath, "README.md"), "pushed\n")
+	git(t, projectPath, "add", ".")
+	git(t, projectPath, "commit", "--quiet", "-m", "init")
+	git(t, projectPath, "push", "--quiet", "origin", "HEAD:main")
+	git(t, projectPath, "branch", "--quiet", "--set-upstream-to=origin/main")
+
+	return projectPath
+}
+
+// newTestDirs returns an empty projects dir and a backup dir path that doesn't exist yet
+func newTestDirs(t testing.TB) (projectsDirPath, backupDirPath string) {
+	t.Helper()
+
+	rootPath := t.TempDir()
+	projectsDirPath = filepath.Join(rootPath, "projects")
+
+	if err := os.Mkdir(projectsDirPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return projectsDirPath, filepath.Join(rootPath, "backup")
+}
+
+// testConfig backs up every kind of change like the CLI does by default, without printing anything
+func testConfig(projectsDirPath, backupDirPath string) Config {
+	return Config{
+		ProjectsDirs: []string{projectsDirPath},
+		BackupDir:    backupDirPath,
+		Remote:       "origin",
+		Untracked:    true,
+		Unstaged:     true,
+		Staged:       true,
+		Unpushed:     true,
+		Jobs:         2,
+		Quiet:        true,
+	}
+}
+
+// runBackup runs the backup, failing the test if it can't start or reports any error
+func runBackup(t testing.TB, cfg Config) Report {
+	t.Helper()
+
+	report, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) > 0 {
+		t.Fatalf("backup failed: %v", report.Errors)
+	}
+
+	return report
+}
+
+func writeTestFile(t testing.TB, path, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t testing.TB, path string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+// assertBackedUp fails the test unless the backup dir has the file with the content
+func assertBackedUp(t testing.TB, backupDirPath, relPath, content string) {
+	t.Helper()
+
+	if got := readTestFile(t, filepath.Join(backupDirPath, filepath.FromSlash(relPath))); got != content {
+		t.Errorf("%s is backed up with %q, want %q", relPath, got, content)
+	}
+}
+
+// assertNotBackedUp fails the test if the backup dir has the file
+func assertNotBackedUp(t testing.TB, backupDirPath, relPath string) {
+	t.Helper()
+
+	if _, err := os.Lstat(filepath.Join(backupDirPath, filepath.FromSlash(relPath))); !os.IsNotExist(err) {
+		t.Errorf("%s is in the backup, want it missing (%v)", relPath, err)
+	}
+}
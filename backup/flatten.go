@@ -0,0 +1,21 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// flattenedPathSeparator joins the path elements of a file flattened via "--flatten",
+// so that "project/path/to/file" is backed up as "project__path__to__file" directly in the backup dir
+const flattenedPathSeparator = "__"
+
+// flattenRelPath joins the path elements into a single file name
+func flattenRelPath(relPath string) string {
+	return strings.ReplaceAll(relPath, string(filepath.Separator), flattenedPathSeparator)
+}
+
+// unflattenRelPath splits a flattened file name back into its path elements.
+// It's only a fallback for the files missing from the manifest, as a name with the separator in it can't be told apart.
+func unflattenRelPath(flattenedRelPath string) string {
+	return strings.ReplaceAll(flattenedRelPath, flattenedPathSeparator, string(filepath.Separator))
+}
@@ -0,0 +1,226 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// gitCommand prepares a git command that runs inside the project directory.
+// The process working directory is never changed, so projects can be scanned concurrently.
+func (run *backupRun) gitCommand(projectDirPath string, args ...string) *exec.Cmd {
+	cmd := exec.Command(run.config.GitBinary, append([]string{"--no-pager"}, args...)...)
+	cmd.Dir = projectDirPath
+
+	return cmd
+}
+
+// gitError describes a failed git command along with the message git printed, like "fatal: bad object",
+// as the exit status alone doesn't tell what went wrong
+func gitError(command string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if message := strings.TrimSpace(string(exitErr.Stderr)); message != "" {
+			return fmt.Errorf("git %s: %w: %s", command, err, strings.ReplaceAll(message, "\n", "; "))
+		}
+	}
+
+	return fmt.Errorf("git %s: %w", command, err)
+}
+
+// listGitPaths runs a git command listing file paths, like "ls-files" or "diff --name-only", and returns the paths.
+// The paths are separated by NUL via "-z", so special characters in them aren't quoted.
+func (run *backupRun) listGitPaths(projectDirPath string, args ...string) ([]string, error) {
+	stdout, err := run.gitCommand(projectDirPath, append(args, "-z")...).Output()
+	if err != nil {
+		return nil, gitError(args[0], err)
+	}
+
+	return strings.Split(filepath.FromSlash(string(stdout)), "\x00"), nil
+}
+
+// currentBranch returns the name of the checked out branch.
+// It's empty when a specific commit is checked out.
+func (run *backupRun) currentBranch(projectDirPath string) (string, error) {
+	branchNameStdout, err := run.gitCommand(projectDirPath, "branch", "--show-current").Output()
+	if err != nil {
+		return "", gitError("branch", err)
+	}
+
+	return strings.TrimSpace(string(branchNameStdout)), nil
+}
+
+// currentCommit returns the full hash of the checked out commit
+func (run *backupRun) currentCommit(projectDirPath string) (string, error) {
+	commitStdout, err := run.gitCommand(projectDirPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", gitError("rev-parse", err)
+	}
+
+	return strings.TrimSpace(string(commitStdout)), nil
+}
+
+// refExists reports whether the ref like "origin/main" points to a commit
+func (run *backupRun) refExists(projectDirPath, ref string) bool {
+	return run.gitCommand(projectDirPath, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Run() == nil
+}
+
+// localBranches returns the names of every local branch
+func (run *backupRun) localBranches(projectDirPath string) ([]string, error) {
+	branchesStdout, err := run.gitCommand(projectDirPath, "for-each-ref", "--format=%(refname:short)", "refs/heads").Output()
+	if err != nil {
+		return nil, gitError("for-each-ref", err)
+	}
+
+	return strings.Fields(string(branchesStdout)), nil
+}
+
+// upstreamRef returns the remote-tracking branch that the branch is configured to push to and pull from,
+// like "refs/remotes/upstream/main". It's empty if the branch has no upstream or tracks a local branch.
+func (run *backupRun) upstreamRef(projectDirPath, branchName string) string {
+	upstreamStdout, err := run.gitCommand(projectDirPath, "rev-parse", "--symbolic-full-name", branchName+"@{upstream}").Output()
+	if err != nil {
+		return ""
+	}
+
+	upstream := strings.TrimSpace(string(upstreamStdout))
+	if !strings.HasPrefix(upstream, "refs/remotes/") {
+		return ""
+	}
+
+	return upstream
+}
+
+// projectRemote returns the remote that the branches without an upstream of the project are compared with.
+// It's the configured remote if the project has it, otherwise the push default of the project, or its only remote,
+// so that a project cloned from a fork or under another remote name isn't compared with a missing remote.
+func (run *backupRun) projectRemote(projectDirPath string) string {
+	remotesStdout, err := run.gitCommand(projectDirPath, "remote").Output()
+	if err != nil {
+		return run.config.Remote
+	}
+
+	remotes := strings.Fields(string(remotesStdout))
+	if slices.Contains(remotes, run.config.Remote) {
+		return run.config.Remote
+	}
+
+	pushDefaultStdout, err := run.gitCommand(projectDirPath, "config", "remote.pushDefault").Output()
+	if pushDefault := strings.TrimSpace(string(pushDefaultStdout)); err == nil && slices.Contains(remotes, pushDefault) {
+		return pushDefault
+	}
+
+	if len(remotes) == 1 {
+		return remotes[0]
+	}
+
+	return run.config.Remote
+}
+
+// findUnpushedBase returns the commit that the local changes of the branch are compared against to find the unpushed ones.
+// It's the configured upstream of the branch, otherwise the branch with the same name on the remote of the project.
+// A branch that doesn't exist on the remote is compared from where it forked off any remote branch instead,
+// which is reported via isFallback. An empty base means none of its commits are on a remote, so every committed file is unpushed.
+//
+// A detached HEAD, where the branch name is empty, only has its working tree changes unpushed
+// if any remote branch contains it. Otherwise, it's handled like a branch that doesn't exist on the remote.
+func (run *backupRun) findUnpushedBase(projectDirPath, remote, branchName string) (base string, isFallback bool, err error) {
+	if branchName == "" {
+		remoteBranchesStdout, err := run.gitCommand(projectDirPath, "branch", "--remotes", "--contains", "HEAD").Output()
+		if err == nil && strings.TrimSpace(string(remoteBranchesStdout)) != "" {
+			return "HEAD", false, nil
+		}
+	} else {
+		// The upstream may be on another remote or have another name, like "upstream/main" for a fork
+		if upstream := run.upstreamRef(projectDirPath, branchName); upstream != "" && run.refExists(projectDirPath, upstream) {
+			return upstream, false, nil
+		}
+
+		remoteRef := remote + "/" + branchName
+		if run.refExists(projectDirPath, remoteRef) {
+			return remoteRef, false, nil
+		}
+	}
+
+	// A branch without any commit has nothing on the remote
+	if !run.refExists(projectDirPath, branchRef(branchName)) {
+		return "", true, nil
+	}
+
+	// "<remote>/HEAD" is missing after a plain `git remote add` and push, so the fork point is found from every remote branch.
+	// Following the first parents, the oldest commit that isn't on any remote has its parent on one.
+	unpushedStdout, err := run.gitCommand(
+		projectDirPath, "rev-list", "--first-parent", branchRef(branchName), "--not", "--remotes",
+	).Output()
+	if err != nil {
+		return "", false, gitError("rev-list", err)
+	}
+
+	unpushedCommits := strings.Fields(string(unpushedStdout))
+	if len(unpushedCommits) == 0 {
+		return branchRef(branchName), true, nil
+	}
+
+	forkStdout, err := run.gitCommand(
+		projectDirPath, "rev-parse", "--verify", "--quiet", unpushedCommits[len(unpushedCommits)-1]+"^",
+	).Output()
+	if err != nil {
+		// The root commit is reached, so none of the commits are on a remote
+		return "", true, nil
+	}
+
+	return strings.TrimSpace(string(forkStdout)), true, nil
+}
+
+// branchRef returns the unambiguous ref of a local branch, or HEAD if the branch name is empty
+func branchRef(branchName string) string {
+	if branchName == "" {
+		return "HEAD"
+	}
+
+	return "refs/heads/" + branchName
+}
+
+// listSubmodules returns the paths, relative to the project dir, of the initialized submodules.
+// Uninitialized submodules have no files to back up, so they are skipped with a warning.
+func (run *backupRun) listSubmodules(project project) ([]string, error) {
+	statusStdout, err := run.gitCommand(project.path, "submodule", "status").Output()
+	if err != nil {
+		return nil, gitError("submodule", err)
+	}
+
+	submoduleRelPaths := []string{}
+
+	// Each line is like " <commit> <path> (<describe>)", where the first character marks the state
+	for _, line := range strings.Split(string(statusStdout), "\n") {
+		if len(line) < 2 {
+			continue
+		}
+
+		_, submodulePath, ok := strings.Cut(strings.TrimSpace(line[1:]), " ")
+		if !ok {
+			continue
+		}
+
+		// Uninitialized submodules have no description
+		if strings.HasSuffix(submodulePath, ")") {
+			if descriptionStart := strings.LastIndex(submodulePath, " ("); descriptionStart >= 0 {
+				submodulePath = submodulePath[:descriptionStart]
+			}
+		}
+
+		submoduleRelPath := filepath.FromSlash(submodulePath)
+
+		if line[0] == '-' {
+			run.logWarning(fmt.Sprintf("%s: submodule %s isn't initialized, skipping", project.name, submoduleRelPath))
+			continue
+		}
+
+		submoduleRelPaths = append(submoduleRelPaths, submoduleRelPath)
+	}
+
+	return submoduleRelPaths, nil
+}
@@ -0,0 +1,15 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGitErrorIncludesStderr(t *testing.T) {
+	run := newBackupRun(Config{GitBinary: "git", Quiet: true})
+
+	_, err := run.listGitPaths(t.TempDir(), "ls-files")
+	if err == nil || !strings.Contains(err.Error(), "not a git repository") {
+		t.Errorf("git in a dir without a project failed with %v, want the reason git printed", err)
+	}
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// journalFileName is the file in the backup root that records the copied files of a run until its manifest is written.
+// It's left behind by an interrupted run, so that the next run skips the files already copied instead of hashing them again.
+const journalFileName = ".git-backup-journal.jsonl"
+
+// journal appends a line per copied file as soon as the copy is complete
+type journal struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+type journalLine struct {
+	Path string `json:"path"`
+	manifestEntry
+}
+
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{file: file}, nil
+}
+
+// record appends the manifest entry of a copied file. Each line is written in a single call, so a killed run leaves at most the last line cut.
+func (j *journal) record(relPath string, entry manifestEntry) error {
+	line, err := json.Marshal(journalLine{Path: filepath.ToSlash(relPath), manifestEntry: entry})
+	if err != nil {
+		return err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	_, err = j.file.Write(append(line, '\n'))
+
+	return err
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// readJournal merges the files recorded by an interrupted run into the manifest. A missing journal has nothing to merge.
+// Unreadable lines, like the one cut by a power loss, are skipped, as their files are only compared once more.
+func readJournal(path string, m manifest) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line journalLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.Path == "" {
+			continue
+		}
+
+		m[filepath.FromSlash(line.Path)] = line.manifestEntry
+	}
+
+	return scanner.Err()
+}
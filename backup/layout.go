@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The layouts of "--layout", which decide the top-level backup dirs of the projects
+const (
+	layoutProjectName = "project-name" // Path of the project dir relative to its projects dir, the default
+	layoutRemoteName  = "remote-name"  // Repository name in the URL of the project's remote
+	layoutSourcePath  = "source-path"  // Full path of the project dir without its root, like "home/user/Projects/app"
+)
+
+// layoutName returns the name that the project is backed up under in the configured layout.
+// A project without a usable remote URL keeps its dir name in the "remote-name" layout, with a warning.
+func (run *backupRun) layoutName(project project) string {
+	switch run.config.Layout {
+	case layoutRemoteName:
+		remote := run.projectRemote(project.path)
+
+		urlStdout, err := run.gitCommand(project.path, "config", "--get", "remote."+remote+".url").Output()
+		name := remoteRepoName(strings.TrimSpace(string(urlStdout)))
+		if err != nil || name == "" || name == "." || name == ".." {
+			run.logWarning(fmt.Sprintf("%s: the remote %s has no URL, backing it up under its directory name", project.name, remote))
+			return project.name
+		}
+
+		return name
+
+	case layoutSourcePath:
+		absPath, err := filepath.Abs(project.path)
+		if err != nil {
+			return project.name
+		}
+
+		// The drive letter of "C:\Users" becomes a dir like "C\Users", and a network share of "\\server\share" becomes "server\share"
+		volumeName := filepath.VolumeName(absPath)
+
+		return strings.TrimLeft(filepath.Join(strings.Trim(volumeName, `\:`), absPath[len(volumeName):]), string(filepath.Separator))
+	}
+
+	return project.name
+}
+
+// remoteRepoName returns the repository name at the end of a remote URL,
+// like "app" of "git@github.com:user/app.git", "https://github.com/user/app" or "/srv/git/app.git"
+func remoteRepoName(url string) string {
+	url = strings.TrimSuffix(strings.TrimRight(url, `/\`), ".git")
+
+	if i := strings.LastIndexAny(url, `/\:`); i >= 0 {
+		url = url[i+1:]
+	}
+
+	return url
+}
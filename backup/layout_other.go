@@ -0,0 +1,10 @@
+//go:build !windows
+
+package backup
+
+import "path/filepath"
+
+// sourceLayoutPath returns the full path that a path of the "source-path" layout was backed up from
+func sourceLayoutPath(relPath string) string {
+	return string(filepath.Separator) + relPath
+}
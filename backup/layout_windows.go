@@ -0,0 +1,17 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// sourceLayoutPath returns the full path that a path of the "source-path" layout was backed up from.
+// A single letter top-level dir is a drive, and anything else is the server of a network share.
+func sourceLayoutPath(relPath string) string {
+	topLevelDirName, rest, _ := strings.Cut(relPath, string(filepath.Separator))
+	if len(topLevelDirName) == 1 {
+		return topLevelDirName + `:\` + rest
+	}
+
+	return `\\` + relPath
+}
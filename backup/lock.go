@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFileName is the file in the backup root that marks a backup run in progress
+const lockFileName = ".git-backup.lock"
+
+// lockWriteTimeout is how long a lock file without a PID is taken as being written by the process that has just created it
+const lockWriteTimeout = time.Minute
+
+// acquireLock creates the lock file of the backup dir containing the PID of this process.
+// A lock left behind by a process that no longer runs, or without a PID for over [lockWriteTimeout], is replaced.
+// "--force-unlock" replaces any lock.
+func (run *backupRun) acquireLock(backupDirPath string) (lockPath string, err error) {
+	lockPath = filepath.Join(backupDirPath, lockFileName)
+
+	for range 2 {
+		lockFile, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(lockFile, os.Getpid())
+			if closeErr := lockFile.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return "", err
+			}
+
+			return lockPath, nil
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+
+		pid, lockTime, err := readLock(lockPath)
+
+		// The lock is released in the meantime, so it's created again
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if !run.config.ForceUnlock && pid > 0 && isProcessRunning(pid) {
+			return "", fmt.Errorf("another backup (PID %d) is running on %s, use \"--force-unlock\" if it isn't", pid, backupDirPath)
+		}
+
+		// The PID is written right after the lock file is created, so a recent lock without one is held as well
+		if !run.config.ForceUnlock && pid == 0 && time.Since(lockTime) < lockWriteTimeout {
+			return "", fmt.Errorf("another backup is starting on %s, use \"--force-unlock\" if it isn't", backupDirPath)
+		}
+
+		run.logWarning("Removing the stale lock file", lockPath)
+
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("failed to lock %s", backupDirPath)
+}
+
+// readLock returns the PID in the lock file and its modification time. The PID is 0 if it's missing or invalid.
+func readLock(lockPath string) (pid int, modTime time.Time, err error) {
+	lockFile, err := os.Open(lockPath)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer lockFile.Close()
+
+	info, err := lockFile.Stat()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	content, err := io.ReadAll(lockFile)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	pid, err = strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid < 0 {
+		pid = 0
+	}
+
+	return pid, info.ModTime(), nil
+}
+
+// releaseLock removes the lock file created by [acquireLock]. It does nothing if no lock was acquired.
+func (run *backupRun) releaseLock(lockPath string) {
+	if lockPath == "" {
+		return
+	}
+
+	if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+		run.logError("Failed to remove the lock file:", err)
+	}
+}
@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		age       time.Duration
+		wantError string
+	}{
+		{"running process", fmt.Sprintln(os.Getpid()), 0, "is running"},
+		{"lock being written", "", 0, "is starting"},
+		{"unparseable lock being written", "garbage", 0, "is starting"},
+		{"abandoned empty lock", "", 2 * lockWriteTimeout, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backupDirPath := t.TempDir()
+			lockPath := filepath.Join(backupDirPath, lockFileName)
+
+			writeTestFile(t, lockPath, test.content)
+			if test.age > 0 {
+				modTime := time.Now().Add(-test.age)
+				if err := os.Chtimes(lockPath, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			run := newBackupRun(Config{Quiet: true})
+
+			_, err := run.acquireLock(backupDirPath)
+			if test.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := strings.TrimSpace(readTestFile(t, lockPath)); got != fmt.Sprint(os.Getpid()) {
+					t.Errorf("lock has %q, want the PID of this process", got)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantError) {
+				t.Errorf("acquireLock returned %v, want an error with %q", err, test.wantError)
+			}
+		})
+	}
+}
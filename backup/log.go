@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Informational output goes to stdout and is filtered by "--verbose" and "--quiet",
+// while errors always go to stderr, so that silent scheduled runs only surface failures.
+// Every line is also written to [Config.Log] with its level, where "--quiet" doesn't apply.
+
+// logVerbose prints details that are only shown with "--verbose"
+func (run *backupRun) logVerbose(a ...any) {
+	if run.config.Verbose {
+		fmt.Println(a...)
+		run.writeLog("INFO", a...)
+	}
+}
+
+// logInfo prints the regular output that is hidden with "--quiet"
+func (run *backupRun) logInfo(a ...any) {
+	if !run.config.Quiet {
+		fmt.Println(a...)
+	}
+
+	run.writeLog("INFO", a...)
+}
+
+// logWarning prints a problem that doesn't fail the run, regardless of the verbosity
+func (run *backupRun) logWarning(a ...any) {
+	fmt.Fprintln(os.Stderr, append([]any{"Warning:"}, a...)...)
+	run.writeLog("WARN", a...)
+}
+
+// logError prints an error regardless of the verbosity
+func (run *backupRun) logError(a ...any) {
+	fmt.Fprintln(os.Stderr, a...)
+	run.writeLog("ERROR", a...)
+}
+
+// logMutex keeps the lines logged by the concurrent workers from interleaving
+var logMutex sync.Mutex
+
+// writeLog appends a timestamped line of the level to the log, if configured. Blank lines only space out the terminal output.
+// A broken log doesn't fail the backup itself, so the write errors are ignored.
+func (run *backupRun) writeLog(level string, a ...any) {
+	message := strings.TrimSpace(fmt.Sprintln(a...))
+	if run.config.Log == nil || message == "" {
+		return
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	fmt.Fprintf(run.config.Log, "%s %-5s %s\n", time.Now().Format(time.RFC3339), level, message)
+}
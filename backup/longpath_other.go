@@ -0,0 +1,8 @@
+//go:build !windows
+
+package backup
+
+// longPath returns the path as is, as only Windows has a path length limit that needs a workaround
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPathLength is the longest path Windows APIs accept without the extended-length prefix.
+// Directories are limited to 248 characters instead of 260, as there must be room for an 8.3 file name.
+const maxPathLength = 248
+
+// longPath returns the extended-length form like `\\?\C:\...` of a path that exceeds the Windows path limit,
+// which is common in deeply nested trees like node_modules.
+// The prefix disables the path normalization, so the path is made absolute and cleaned first.
+func longPath(path string) string {
+	if len(path) < maxPathLength || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+
+	// Network shares like `\\server\share` have their own prefix
+	if strings.HasPrefix(absPath, `\\`) {
+		return `\\?\UNC\` + absPath[2:]
+	}
+
+	return `\\?\` + absPath
+}
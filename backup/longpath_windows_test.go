@@ -0,0 +1,27 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	longName := strings.Repeat("node_modules\\", 20) + "index.js"
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`C:\projects\app\index.js`, `C:\projects\app\index.js`},
+		{`C:\` + longName, `\\?\C:\` + longName},
+		{`C:\projects\.\app\..\` + longName, `\\?\C:\projects\` + longName},
+		{`\\server\share\` + longName, `\\?\UNC\server\share\` + longName},
+		{`\\?\C:\` + longName, `\\?\C:\` + longName},
+	}
+
+	for _, test := range tests {
+		if got := longPath(test.path); got != test.want {
+			t.Errorf("longPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
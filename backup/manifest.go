@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// manifestFileName is the file in the backup root that records the state of every backed up project file
+const manifestFileName = ".git-backup-manifest.json"
+
+// manifest maps the backed up file paths to the state of their source files at the time of the backup
+type manifest map[string]manifestEntry
+
+// projectStates maps the project names to the state of the projects at the time of their last complete backup
+type projectStates map[string]projectState
+
+type projectState struct {
+	BackedUpAt int64 `json:"backed_up_at"` // Unix time in nanoseconds of the start of the last complete backup
+}
+
+// manifestLayout is the content of the manifest file
+type manifestLayout struct {
+	Files    manifest      `json:"files"`
+	Projects projectStates `json:"projects"`
+}
+
+type manifestEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix time in nanoseconds
+	Hash    string `json:"sha256"`
+
+	// Path of the source file relative to the projects dir, if it was changed via "--sanitize-names"
+	SourcePath string `json:"source_path,omitempty"`
+}
+
+func newManifestEntry(info fs.FileInfo, hash []byte) *manifestEntry {
+	return &manifestEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hex.EncodeToString(hash),
+	}
+}
+
+// matches reports whether the source file still has the same size and modification time as recorded
+func (entry manifestEntry) matches(info fs.FileInfo) bool {
+	return entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano()
+}
+
+// readManifest loads the manifest from the backup dir. A missing manifest is empty.
+func readManifest(path string) (manifest, projectStates, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest{}, projectStates{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, nil, err
+	}
+
+	// Manifests written before the project states were recorded only have the files at the top level.
+	// A file path always has a project dir, so it can't be "files".
+	var layout manifestLayout
+	if _, ok := fields["files"]; ok {
+		err = json.Unmarshal(content, &layout)
+	} else {
+		err = json.Unmarshal(content, &layout.Files)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Paths are stored with forward slashes, so the backup can be shared between operating systems
+	m := make(manifest, len(layout.Files))
+	for slashPath, entry := range layout.Files {
+		m[filepath.FromSlash(slashPath)] = entry
+	}
+
+	states := make(projectStates, len(layout.Projects))
+	for slashName, state := range layout.Projects {
+		states[filepath.FromSlash(slashName)] = state
+	}
+
+	return m, states, nil
+}
+
+// writeManifest atomically replaces the manifest in the backup dir
+func (run *backupRun) writeManifest(path string, m manifest, states projectStates) error {
+	layout := manifestLayout{
+		Files:    make(manifest, len(m)),
+		Projects: make(projectStates, len(states)),
+	}
+
+	for relPath, entry := range m {
+		layout.Files[filepath.ToSlash(relPath)] = entry
+	}
+
+	for projectName, state := range states {
+		layout.Projects[filepath.ToSlash(projectName)] = state
+	}
+
+	content, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = run.writeFile(path, bytes.NewReader(append(content, '\n')), nil)
+
+	return err
+}
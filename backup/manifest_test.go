@@ -0,0 +1,44 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunKeepsInternalFiles(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+	writeTestFile(t, filepath.Join(projectPath, "draft.txt"), "draft")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	cfg.Checksums = true
+	cfg.RemovalLog = true
+	runBackup(t, cfg)
+
+	// The next full run removes a backed up file, but none of the files of the tool itself, which no project has
+	if err := os.Remove(filepath.Join(projectPath, "draft.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	report := runBackup(t, cfg)
+
+	if report.FilesRemoved != 1 {
+		t.Errorf("%d files are removed, want only the deleted project file", report.FilesRemoved)
+	}
+
+	for _, fileName := range []string{manifestFileName, checksumsFileName, removalLogFileName} {
+		if _, err := os.Stat(filepath.Join(backupDirPath, fileName)); err != nil {
+			t.Errorf("%s is removed from the backup: %v", fileName, err)
+		}
+	}
+
+	backupManifest, _, err := readManifest(filepath.Join(backupDirPath, manifestFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backupManifest[filepath.Join("app", "notes.txt")]; !ok || len(backupManifest) != 1 {
+		t.Errorf("manifest has %d entries, want only the one of app/notes.txt", len(backupManifest))
+	}
+}
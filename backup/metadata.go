@@ -0,0 +1,257 @@
+package backup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metadataDirName is the directory inside each backed up project that holds the git state
+// which can't be captured by copying files, like the stashes, unpushed commits and the detached HEAD
+const metadataDirName = ".git-backup"
+
+// listStashPatches exports every stash of the project as a patch file
+func (run *backupRun) listStashPatches(projectDirPath string) ([]generatedFile, error) {
+	stashListStdout, err := run.gitCommand(projectDirPath, "stash", "list", "--format=%gd").Output()
+	if err != nil {
+		return nil, gitError("stash list", err)
+	}
+
+	patches := []generatedFile{}
+
+	for i, stashRef := range strings.Fields(string(stashListStdout)) {
+		patchStdout, err := run.gitCommand(projectDirPath, "stash", "show", "--patch", "--binary", stashRef).Output()
+		if err != nil {
+			return nil, gitError("stash show "+stashRef, err)
+		}
+
+		if len(patchStdout) == 0 {
+			continue
+		}
+
+		patches = append(patches, generatedFile{
+			relPath: filepath.Join(metadataDirName, "stashes", fmt.Sprintf("stash-%d.patch", i)),
+			content: patchStdout,
+		})
+	}
+
+	return patches, nil
+}
+
+// listCommitPatches exports the commits of the current branch or detached HEAD that aren't pushed to the remote as patch files
+func (run *backupRun) listCommitPatches(projectDirPath string) ([]generatedFile, error) {
+	branchName, err := run.currentBranch(projectDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return run.formatUnpushedPatches(projectDirPath, branchName, filepath.Join(metadataDirName, "patches"))
+}
+
+// listBranchPatches exports the unpushed commits of every local branch other than the checked out one as patch files
+// into a directory per branch. The branches aren't checked out, so their changes are only captured as commits.
+func (run *backupRun) listBranchPatches(projectDirPath string) ([]generatedFile, error) {
+	checkedOutBranchName, err := run.currentBranch(projectDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	branchNames, err := run.localBranches(projectDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	patches := []generatedFile{}
+
+	for _, branchName := range branchNames {
+		if branchName == checkedOutBranchName {
+			continue
+		}
+
+		branchPatches, err := run.formatUnpushedPatches(projectDirPath, branchName, filepath.Join(metadataDirName, "branches", branchName))
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, branchPatches...)
+	}
+
+	return patches, nil
+}
+
+// listUnpushedTags exports the tags pointing to the commits that aren't on any remote into a file per tag.
+// An annotated tag is exported as its raw tag object, which "git mktag" recreates as is, including the message and the signature.
+// A lightweight tag is exported as the hash of its commit.
+func (run *backupRun) listUnpushedTags(projectDirPath string) ([]generatedFile, error) {
+	tagsStdout, err := run.gitCommand(projectDirPath, "for-each-ref", "--format=%(refname:strip=2) %(objecttype) %(objectname) %(*objectname)", "refs/tags").Output()
+	if err != nil {
+		return nil, gitError("for-each-ref", err)
+	}
+
+	if len(strings.TrimSpace(string(tagsStdout))) == 0 {
+		return []generatedFile{}, nil
+	}
+
+	// Commits reachable from the tags but not from any remote branch, which is usually only a handful
+	unpushedStdout, err := run.gitCommand(projectDirPath, "rev-list", "--tags", "--not", "--remotes").Output()
+	if err != nil {
+		return nil, gitError("rev-list", err)
+	}
+
+	unpushedCommits := make(map[string]struct{})
+	for _, commit := range strings.Fields(string(unpushedStdout)) {
+		unpushedCommits[commit] = struct{}{}
+	}
+
+	tags := []generatedFile{}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(tagsStdout)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		tagName, objectType, objectName := fields[0], fields[1], fields[2]
+
+		// An annotated tag points to its tag object, which is peeled to the tagged commit
+		commit := objectName
+		if objectType == "tag" && len(fields) == 4 {
+			commit = fields[3]
+		}
+
+		if _, isUnpushed := unpushedCommits[commit]; !isUnpushed {
+			continue
+		}
+
+		content := []byte(objectName + "\n")
+		if objectType == "tag" {
+			content, err = run.gitCommand(projectDirPath, "cat-file", "tag", objectName).Output()
+			if err != nil {
+				return nil, gitError("cat-file "+tagName, err)
+			}
+		}
+
+		tags = append(tags, generatedFile{
+			relPath: filepath.Join(metadataDirName, "tags", filepath.FromSlash(tagName)),
+			content: content,
+		})
+	}
+
+	return tags, nil
+}
+
+// formatUnpushedPatches exports the unpushed commits of a branch, or the detached HEAD if the name is empty,
+// as patch files into the directory relative to the project dir
+func (run *backupRun) formatUnpushedPatches(projectDirPath, branchName, patchesRelDirPath string) ([]generatedFile, error) {
+	unpushedBase, _, err := run.findUnpushedBase(projectDirPath, run.projectRemote(projectDirPath), branchName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a base on the remote, the whole history of the branch is unpushed
+	revisionRange := []string{"--root", branchRef(branchName)}
+	if unpushedBase != "" {
+		revisionRange = []string{unpushedBase + ".." + branchRef(branchName)}
+	}
+
+	patchesDirPath, err := os.MkdirTemp("", "git-local-backup-patches-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(patchesDirPath)
+
+	err = run.gitCommand(
+		projectDirPath, append([]string{"format-patch", "--quiet", "--binary", "-o", patchesDirPath}, revisionRange...)...,
+	).Run()
+	if err != nil {
+		return nil, gitError("format-patch", err)
+	}
+
+	patchEntries, err := os.ReadDir(patchesDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	patches := []generatedFile{}
+
+	for _, patchEntry := range patchEntries {
+		content, err := os.ReadFile(filepath.Join(patchesDirPath, patchEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		patches = append(patches, generatedFile{
+			relPath: filepath.Join(patchesRelDirPath, patchEntry.Name()),
+			content: content,
+		})
+	}
+
+	return patches, nil
+}
+
+// createDetachedHeadNote records the checked out commit when HEAD is detached, so that the state can be recovered.
+// It's nil when a branch is checked out.
+func (run *backupRun) createDetachedHeadNote(projectDirPath string) (*generatedFile, error) {
+	branchName, err := run.currentBranch(projectDirPath)
+	if err != nil || branchName != "" {
+		return nil, err
+	}
+
+	commit, err := run.currentCommit(projectDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &generatedFile{
+		relPath: filepath.Join(metadataDirName, "DETACHED_HEAD"),
+		content: []byte(commit + "\n"),
+	}, nil
+}
+
+// generatedFile is a file that doesn't exist in the project, but is created from its git state for the backup
+type generatedFile struct {
+	relPath string // File path relative to the project dir
+	content []byte
+}
+
+// listGitSubpathFiles returns the files of the git dir selected via "--include-git-subpath", relative to the git dir.
+// The object database is never included, as it can be huge and is already backed up by the remote.
+func (run *backupRun) listGitSubpathFiles(gitDirPath string) ([]string, error) {
+	relPaths := []string{}
+
+	for _, subpath := range run.config.GitSubpaths {
+		err := filepath.WalkDir(filepath.Join(gitDirPath, subpath), func(path string, entry fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			// Also skips the object databases of the submodules in "modules"
+			if entry.IsDir() && entry.Name() == "objects" {
+				return filepath.SkipDir
+			}
+
+			if entry.IsDir() {
+				return nil
+			}
+
+			relPath, err := filepath.Rel(gitDirPath, path)
+			if err != nil {
+				return err
+			}
+
+			relPaths = append(relPaths, relPath)
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return relPaths, nil
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// matchPattern reports whether a path relative to the project root matches a glob pattern.
+//
+// Patterns without a directory component like "*.log" or "node_modules" match at any depth.
+// Patterns with a directory component like "config/*.json" are matched from the project root.
+// "**" matches any number of nested directories, and matching a directory also matches everything inside it.
+func matchPattern(pattern, relPath string) bool {
+	separator := string(filepath.Separator)
+
+	pattern = strings.TrimSuffix(pattern, separator)
+	isAnchored := strings.Contains(pattern, separator)
+	pattern = strings.TrimPrefix(pattern, separator)
+
+	patternParts := strings.Split(pattern, separator)
+	if !isAnchored {
+		patternParts = append([]string{"**"}, patternParts...)
+	}
+
+	return matchPatternParts(patternParts, strings.Split(relPath, separator))
+}
+
+func matchPatternParts(patternParts, pathParts []string) bool {
+	// Whole pattern is consumed, so either the path or one of its parent directories has matched
+	if len(patternParts) == 0 {
+		return true
+	}
+
+	if patternParts[0] == "**" {
+		for i := 0; i <= len(pathParts); i++ {
+			if matchPatternParts(patternParts[1:], pathParts[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(pathParts) == 0 {
+		return false
+	}
+
+	isMatched, err := filepath.Match(patternParts[0], pathParts[0])
+
+	return err == nil && isMatched && matchPatternParts(patternParts[1:], pathParts[1:])
+}
+
+// isGlobPattern reports whether a path has any glob syntax, otherwise it's a literal path
+func isGlobPattern(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// findMatchingPaths walks the project dir and returns the paths, relative to the project dir, matching any of the patterns.
+// A matching dir is returned instead of the files inside it. The ".git" dir is never searched.
+func findMatchingPaths(projectDirPath string, patterns []string) (dirRelPaths, fileRelPaths []string, err error) {
+	err = filepath.WalkDir(projectDirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == projectDirPath {
+			return nil
+		}
+
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		relPath, err := filepath.Rel(projectDirPath, path)
+		if err != nil {
+			return err
+		}
+
+		if !matchAnyPattern(patterns, relPath) {
+			return nil
+		}
+
+		if entry.IsDir() {
+			dirRelPaths = append(dirRelPaths, relPath)
+			return filepath.SkipDir
+		}
+
+		fileRelPaths = append(fileRelPaths, relPath)
+
+		return nil
+	})
+
+	return dirRelPaths, fileRelPaths, err
+}
+
+// matchAnyPattern reports whether the path matches at least one of the patterns
+func matchAnyPattern(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, relPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignoreFileName is an optional file at the root of a project with gitignore-style patterns of the files to skip
+const ignoreFileName = ".git-backup-ignore"
+
+// readPatternFile returns the patterns listed in a file, one per line.
+// Blank lines and comments starting with "#" are skipped. A missing file has no patterns.
+func readPatternFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := []string{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, filepath.FromSlash(line))
+	}
+
+	return patterns, nil
+}
+
+// isIgnored reports whether the path is ignored by the gitignore-style patterns.
+// Like gitignore, the last matching pattern wins and a "!" prefix negates a pattern.
+func isIgnored(patterns []string, relPath string) bool {
+	isIgnored := false
+
+	for _, pattern := range patterns {
+		negatedPattern, isNegated := strings.CutPrefix(pattern, "!")
+
+		if matchPattern(negatedPattern, relPath) {
+			isIgnored = !isNegated
+		}
+	}
+
+	return isIgnored
+}
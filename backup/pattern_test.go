@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		want    bool
+	}{
+		{"*.log", "debug.log", true},
+		{"*.log", "logs/nested/debug.log", true},
+		{"*.log", "debug.log.txt", false},
+		{".DS_Store", "assets/.DS_Store", true},
+		{"node_modules", "web/node_modules/pkg/index.js", true},
+		{"config/*.json", "config/app.json", true},
+		{"config/*.json", "web/config/app.json", false},
+		{"config/*.json", "config/nested/app.json", false},
+		{"/build", "build/out.bin", true},
+		{"/build", "web/build/out.bin", false},
+		{"logs/**/*.txt", "logs/a.txt", true},
+		{"logs/**/*.txt", "logs/a/b/c.txt", true},
+		{"logs/**/*.txt", "other/logs/a.txt", false},
+		{"cache/", "cache/entry", true},
+	}
+
+	for _, test := range tests {
+		pattern, relPath := filepath.FromSlash(test.pattern), filepath.FromSlash(test.relPath)
+		if got := matchPattern(pattern, relPath); got != test.want {
+			t.Errorf("matchPattern(%q, %q) = %t, want %t", test.pattern, test.relPath, got, test.want)
+		}
+	}
+}
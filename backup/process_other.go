@@ -0,0 +1,22 @@
+//go:build !windows
+
+package backup
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isProcessRunning reports whether a process with the PID exists
+func isProcessRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	// Signal 0 only checks the existence. A process of another user can't be signaled, but it still exists.
+	err = process.Signal(syscall.Signal(0))
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
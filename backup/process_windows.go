@@ -0,0 +1,16 @@
+package backup
+
+import "os"
+
+// isProcessRunning reports whether a process with the PID exists
+func isProcessRunning(pid int) bool {
+	// Finding a process opens a handle to it, which fails if it doesn't exist
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	process.Release()
+
+	return true
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// progress periodically prints the processed bytes out of the total to stderr.
+// It's also an [io.Writer] that counts the bytes written through it.
+type progress struct {
+	total   int64
+	done    atomic.Int64
+	isTTY   bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func startProgress(total int64) *progress {
+	p := &progress{
+		total:   total,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	if info, err := os.Stderr.Stat(); err == nil {
+		p.isTTY = info.Mode()&os.ModeCharDevice != 0
+	}
+
+	// Redrawing a single line only works on a terminal, so logs get a new line far less frequently
+	interval := 10 * time.Second
+	if p.isTTY {
+		interval = 200 * time.Millisecond
+	}
+
+	go func() {
+		defer close(p.stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.stop:
+				p.print()
+				if p.isTTY {
+					fmt.Fprintln(os.Stderr)
+				}
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done.Add(int64(len(b)))
+
+	return len(b), nil
+}
+
+// add counts bytes that were processed without being written, e.g. of the unchanged files
+func (p *progress) add(n int64) {
+	p.done.Add(n)
+}
+
+// finish prints the final progress and stops the updates
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.stopped
+}
+
+func (p *progress) print() {
+	done := p.done.Load()
+
+	percentage := 100
+	if p.total > 0 {
+		percentage = int(min(done*100/p.total, 100))
+	}
+
+	line := fmt.Sprintf("Backed up %s / %s (%d%%)", FormatSize(done), FormatSize(p.total), percentage)
+
+	if p.isTTY {
+		// Clear the rest of the previous line in case it was longer
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", line)
+	} else {
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
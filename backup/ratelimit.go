@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that refills at a fixed number of bytes per second,
+// holding at most a second worth of bytes for bursts.
+type rateLimiter struct {
+	mu         sync.Mutex
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:       float64(bytesPerSecond),
+		tokens:     float64(bytesPerSecond),
+		lastRefill: time.Now(),
+	}
+}
+
+// wait takes n bytes from the bucket, blocking until they are refilled if the bucket runs out.
+// The bucket may go into debt, so concurrent callers queue up behind each other instead of starving.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.lastRefill).Seconds()*l.rate, l.rate)
+	l.lastRefill = now
+	l.tokens -= float64(n)
+
+	delay := time.Duration(0)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// reader returns a reader that doesn't read faster than the limit
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	return &rateLimitedReader{reader: r, limiter: l}
+}
+
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	// Smaller reads than the bucket size keep the throughput smooth
+	if len(b) > int(r.limiter.rate) {
+		b = b[:max(int(r.limiter.rate), 1)]
+	}
+
+	n, err := r.reader.Read(b)
+	r.limiter.wait(n)
+
+	return n, err
+}
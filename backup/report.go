@@ -0,0 +1,51 @@
+package backup
+
+import "time"
+
+// Report is a machine-readable summary of a backup run.
+// In dry-run mode, the counts are of the changes that would have been made.
+// In check mode, the copied and updated files are the ones missing from or differing in the backup.
+type Report struct {
+	DryRun          bool                      `json:"dry_run"`
+	Check           bool                      `json:"check"`
+	ProjectsScanned int                       `json:"projects_scanned"`
+	ProjectsFailed  int                       `json:"projects_failed"`
+	FilesCopied     int                       `json:"files_copied"`
+	FilesUpdated    int                       `json:"files_updated"`
+	FilesRemoved    int                       `json:"files_removed"`
+	FilesSkipped    int                       `json:"files_skipped"`
+	BytesCopied     int64                     `json:"bytes_copied"`
+	Duration        time.Duration             `json:"duration_ns"` // Wall time of the whole run
+	Truncated       bool                      `json:"truncated"`   // Whether some projects or files were left for the next run by the time budget
+	Projects        map[string]*ProjectReport `json:"projects"`
+	Errors          []string                  `json:"errors"`
+	Warnings        []string                  `json:"warnings"` // Problems that didn't fail the run, like files modified while being copied
+}
+
+// ProjectReport is the part of the report about a single project
+type ProjectReport struct {
+	FilesCopied   int           `json:"files_copied"`
+	FilesUpdated  int           `json:"files_updated"`
+	BytesCopied   int64         `json:"bytes_copied"`
+	FilesBackedUp int           `json:"files_backed_up"` // Files in the backup after the run, including the unchanged ones
+	BytesBackedUp int64         `json:"bytes_backed_up"`
+	ScanDuration  time.Duration `json:"scan_duration_ns"` // Time it took to list the files of the project
+	Errors        []string      `json:"errors"`
+}
+
+func (run *backupRun) newReport(projects []project) *Report {
+	report := &Report{
+		DryRun:          run.config.DryRun,
+		Check:           run.config.Check,
+		ProjectsScanned: len(projects),
+		Projects:        make(map[string]*ProjectReport),
+		Errors:          []string{},
+		Warnings:        []string{},
+	}
+
+	for _, project := range projects {
+		report.Projects[project.name] = &ProjectReport{Errors: []string{}}
+	}
+
+	return report
+}
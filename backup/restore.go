@@ -0,0 +1,269 @@
+package backup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RestoreReport is a summary of a restore run
+type RestoreReport struct {
+	FilesRestored int      `json:"files_restored"`
+	FilesSkipped  int      `json:"files_skipped"`
+	Truncated     bool     `json:"truncated"` // Whether some files were left unrestored by an interrupt
+	Errors        []string `json:"errors"`
+}
+
+// Restore copies every backed up file back into its project.
+// Files that already exist in the projects are left untouched unless forced.
+// Closing the stop channel, like on an interrupt, stops before the next file, while the restored ones are kept.
+// Failures of a single file are collected in the report, while the error is only returned when the restore can't run.
+func Restore(cfg Config) (RestoreReport, error) {
+	if err := cfg.validate(); err != nil {
+		return RestoreReport{}, err
+	}
+
+	run := newBackupRun(cfg)
+
+	if run.config.DryRun {
+		run.logInfo("Simulating changes to projects directory:")
+		run.logInfo()
+	}
+
+	if run.config.Archive != "" {
+		return run.restoreArchive()
+	}
+
+	lockPath := ""
+	if !run.config.DryRun {
+		var err error
+		lockPath, err = run.acquireLock(run.config.BackupDir)
+		if err != nil {
+			return RestoreReport{}, err
+		}
+	}
+	defer run.releaseLock(lockPath)
+
+	var err error
+	run.backupManifest, _, err = readManifest(filepath.Join(run.config.BackupDir, manifestFileName))
+	if err != nil {
+		return RestoreReport{}, err
+	}
+
+	report := RestoreReport{Errors: []string{}}
+
+	err = filepath.WalkDir(run.config.BackupDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if run.isInterrupted() {
+			report.Truncated = true
+			return filepath.SkipAll
+		}
+
+		// Removed files in a trash dir inside the backup dir aren't restored, and the objects are restored through the files pointing to them
+		if run.isInternalPath(path) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if entry.IsDir() {
+			// Exported git state like stash patches has to be applied manually
+			if entry.Name() == metadataDirName {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		entryRelPath, err := filepath.Rel(run.config.BackupDir, path)
+		if err != nil {
+			return err
+		}
+
+		projectRelPath := entryRelPath
+
+		// Every regular file of a compressed backup has the extension added
+		isCompressedFile := entry.Type().IsRegular() && run.isCompressed(entryRelPath)
+		if isCompressedFile {
+			projectRelPath = strings.TrimSuffix(projectRelPath, compressedFileExt)
+		}
+
+		// Files renamed via "--sanitize-names" or "--flatten" get their original paths back
+		if manifestEntry, ok := run.backupManifest[entryRelPath]; ok && manifestEntry.SourcePath != "" {
+			projectRelPath = filepath.FromSlash(manifestEntry.SourcePath)
+		} else if run.config.Flatten {
+			projectRelPath = unflattenRelPath(projectRelPath)
+		}
+
+		projectFilePath, err := run.findRestorePath(projectRelPath)
+		if err != nil {
+			run.logError(err)
+			report.Errors = append(report.Errors, err.Error())
+			return nil
+		}
+
+		if !run.config.Force {
+			if _, err := os.Lstat(projectFilePath); !os.IsNotExist(err) {
+				run.logVerbose("=", entryRelPath, "(already exists)")
+				report.FilesSkipped++
+				return nil
+			}
+		}
+
+		report.FilesRestored++
+
+		if run.config.DryRun {
+			run.logInfo("+", entryRelPath)
+			return nil
+		}
+
+		var objectHash []byte
+		objectHash, err = readObjectPointer(path)
+		if err == nil {
+			switch {
+			case objectHash != nil:
+				err = run.copyFileAsIs(run.objectPath(objectHash), projectFilePath)
+			case isCompressedFile:
+				err = run.decompressFile(path, projectFilePath)
+			default:
+				err = run.copyFileAsIs(path, projectFilePath)
+			}
+		}
+
+		if err != nil {
+			run.logError(err)
+			report.Errors = append(report.Errors, err.Error())
+			report.FilesRestored--
+			return nil
+		}
+
+		run.logVerbose("+", entryRelPath, "(restored)")
+
+		return nil
+	})
+
+	return report, err
+}
+
+// isInterrupted reports whether the stop channel is closed, like on an interrupt
+func (run *backupRun) isInterrupted() bool {
+	select {
+	case <-run.config.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// findRestorePath returns where a backed up file is restored to, from its path relative to the projects dir.
+// The files of the plain dirs and the "source-path" layout are restored to their original paths.
+// It fails if there's no project to restore the file into, or if the path leads outside the projects,
+// like a crafted manifest entry "../../.bashrc" or a flattened name "..__.bashrc",
+// or through a symlink leading outside its project, like an archived "app/link" to "/etc" before "app/link/passwd".
+func (run *backupRun) findRestorePath(projectRelPath string) (string, error) {
+	if !filepath.IsLocal(projectRelPath) {
+		return "", fmt.Errorf("refusing to restore %s outside the projects", projectRelPath)
+	}
+
+	for _, plainDirPath := range run.config.PlainDirs {
+		if plainDirRelPath, ok := strings.CutPrefix(projectRelPath, run.plainDirName(plainDirPath)+string(filepath.Separator)); ok {
+			return restorePathInside(plainDirPath, plainDirRelPath)
+		}
+	}
+
+	// The full paths of the "source-path" layout have no project root to stay inside
+	if run.config.Layout == layoutSourcePath {
+		return sourceLayoutPath(projectRelPath), nil
+	}
+
+	projectsPath := run.findRestoreProjectsPath(projectRelPath)
+	if projectsPath == "" {
+		return "", fmt.Errorf("no project is given to restore %s into", projectRelPath)
+	}
+
+	// The project dir itself may be a symlink, so only the dirs inside it are checked
+	projectName, fileRelPath, ok := strings.Cut(projectRelPath, string(filepath.Separator))
+	if !ok {
+		return filepath.Join(projectsPath, projectRelPath), nil
+	}
+
+	return restorePathInside(filepath.Join(projectsPath, projectName), fileRelPath)
+}
+
+// restorePathInside joins the relative path to the root dir, failing if any of its existing parent dirs
+// is a symlink that resolves outside the root
+func restorePathInside(rootPath, relPath string) (string, error) {
+	restorePath := filepath.Join(rootPath, relPath)
+
+	parentRelPath := filepath.Dir(relPath)
+	if parentRelPath == "." {
+		return restorePath, nil
+	}
+
+	realRootPath, err := filepath.EvalSymlinks(rootPath)
+	if os.IsNotExist(err) {
+		return restorePath, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	parentPath := rootPath
+	for _, name := range strings.Split(parentRelPath, string(filepath.Separator)) {
+		parentPath = filepath.Join(parentPath, name)
+
+		info, err := os.Lstat(parentPath)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+
+		realParentPath, err := filepath.EvalSymlinks(parentPath)
+		if err == nil {
+			realParentPath, err = filepath.Rel(realRootPath, realParentPath)
+		}
+		if err != nil || !filepath.IsLocal(realParentPath) {
+			return "", fmt.Errorf("refusing to restore %s through the symlink %s outside its project", restorePath, parentPath)
+		}
+	}
+
+	return restorePath, nil
+}
+
+// findRestoreProjectsPath returns the dir that the project of a backed up file is in.
+// It's the parent of the individually given project with the same name as the top-level directory of the file,
+// otherwise the first projects dir that already has that directory, otherwise the first projects dir.
+// It's empty if there are only individual projects and none of them matches.
+func (run *backupRun) findRestoreProjectsPath(backupFileRelPath string) string {
+	topLevelDirName, _, _ := strings.Cut(backupFileRelPath, string(filepath.Separator))
+
+	for _, projectPath := range run.config.ProjectPaths {
+		if filepath.Base(projectPath) == topLevelDirName {
+			return filepath.Dir(projectPath)
+		}
+	}
+
+	for _, projectsPath := range run.config.ProjectsDirs {
+		if _, err := os.Stat(filepath.Join(projectsPath, topLevelDirName)); err == nil {
+			return projectsPath
+		}
+	}
+
+	if len(run.config.ProjectsDirs) == 0 {
+		return ""
+	}
+
+	return run.config.ProjectsDirs[0]
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// restoreConfig restores the backup of the config into a fresh projects dir next to the original one
+func restoreConfig(t testing.TB, cfg Config) Config {
+	t.Helper()
+
+	restoreDirPath := filepath.Join(filepath.Dir(cfg.BackupDir), "restored")
+	if err := os.Mkdir(restoreDirPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ProjectsDirs = []string{restoreDirPath}
+
+	return cfg
+}
+
+func TestRestoreRejectsPathsOutsideProjects(t *testing.T) {
+	t.Run("manifest source path", func(t *testing.T) {
+		projectsDirPath, backupDirPath := newTestDirs(t)
+		projectPath := newProject(t, projectsDirPath, "app")
+		writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+
+		cfg := testConfig(projectsDirPath, backupDirPath)
+		runBackup(t, cfg)
+
+		// A crafted manifest points the backed up file two levels above the projects dir
+		manifestPath := filepath.Join(backupDirPath, manifestFileName)
+
+		var layout map[string]map[string]map[string]any
+		if err := json.Unmarshal([]byte(readTestFile(t, manifestPath)), &layout); err != nil {
+			t.Fatal(err)
+		}
+		layout["files"]["app/notes.txt"]["source_path"] = "../../escaped.txt"
+
+		content, err := json.Marshal(layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, manifestPath, string(content))
+
+		restoreCfg := restoreConfig(t, cfg)
+		assertRestoreRejected(t, restoreCfg, filepath.Join(restoreCfg.ProjectsDirs[0], "..", "..", "escaped.txt"))
+	})
+
+	t.Run("flattened name", func(t *testing.T) {
+		projectsDirPath, backupDirPath := newTestDirs(t)
+		newProject(t, projectsDirPath, "app")
+
+		cfg := testConfig(projectsDirPath, backupDirPath)
+		cfg.Flatten = true
+		runBackup(t, cfg)
+
+		// Unflattened, the name leads one level above the projects dir
+		writeTestFile(t, filepath.Join(backupDirPath, "..__escaped.txt"), "escaped")
+
+		restoreCfg := restoreConfig(t, cfg)
+		assertRestoreRejected(t, restoreCfg, filepath.Join(restoreCfg.ProjectsDirs[0], "..", "escaped.txt"))
+	})
+}
+
+// assertRestoreRejected restores the backup and fails the test unless the file outside the projects is reported and not written
+func assertRestoreRejected(t *testing.T, cfg Config, escapedPath string) {
+	t.Helper()
+
+	report, err := Restore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "outside the projects") {
+		t.Errorf("restore errors are %q, want one about a path outside the projects", report.Errors)
+	}
+
+	if _, err := os.Lstat(escapedPath); !os.IsNotExist(err) {
+		t.Errorf("%s is written outside the projects (%v)", escapedPath, err)
+	}
+}
+
+func TestRestoreInterrupted(t *testing.T) {
+	projectsDirPath, backupDirPath := newTestDirs(t)
+	projectPath := newProject(t, projectsDirPath, "app")
+	writeTestFile(t, filepath.Join(projectPath, "notes.txt"), "notes")
+
+	cfg := testConfig(projectsDirPath, backupDirPath)
+	runBackup(t, cfg)
+
+	archiveCfg := testConfig(projectsDirPath, "")
+	archiveCfg.Archive = filepath.Join(filepath.Dir(backupDirPath), "backup.tar")
+	runBackup(t, archiveCfg)
+
+	stop := make(chan struct{})
+	close(stop)
+
+	for name, restoreCfg := range map[string]Config{"backup dir": cfg, "archive": archiveCfg} {
+		t.Run(name, func(t *testing.T) {
+			restoreCfg.ProjectsDirs = []string{t.TempDir()}
+			restoreCfg.Stop = stop
+
+			report, err := Restore(restoreCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !report.Truncated || report.FilesRestored != 0 {
+				t.Errorf("restore is truncated %t with %d files restored, want it interrupted before any file", report.Truncated, report.FilesRestored)
+			}
+		})
+	}
+}
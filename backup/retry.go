@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// retryBaseDelay is the wait before the first retry, which doubles on each following one
+const retryBaseDelay = 500 * time.Millisecond
+
+// copyFileWithRetries copies a file like [copyFile], but retries the transient failures
+// with an exponential backoff up to the configured number of times.
+func (run *backupRun) copyFileWithRetries(srcPath, dstPath string) ([]byte, error) {
+	delay := retryBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		hash, err := run.copyFile(srcPath, dstPath)
+		if err == nil || attempt > run.config.Retries || !isRetryable(err) {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w (gave up after %d attempts)", err, attempt)
+			}
+
+			return hash, err
+		}
+
+		run.logWarning(fmt.Sprintf("%v - retrying in %s", err, delay))
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isRetryable reports whether an error is likely to go away by itself,
+// like a file temporarily locked by a sync client or a network timeout of a mounted drive.
+// Permanent failures like a denied permission fail right away.
+func isRetryable(err error) bool {
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+
+	if errno.Timeout() || errno.Temporary() {
+		return true
+	}
+
+	switch errno {
+	case syscall.EBUSY, syscall.EIO, syscall.ETIMEDOUT, syscall.EAGAIN, syscall.EINTR:
+		return true
+	}
+
+	return isRetryableErrno(errno)
+}
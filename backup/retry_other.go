@@ -0,0 +1,10 @@
+//go:build !windows
+
+package backup
+
+import "syscall"
+
+// isRetryableErrno reports whether a platform specific error is transient. Every common one is already handled.
+func isRetryableErrno(errno syscall.Errno) bool {
+	return false
+}
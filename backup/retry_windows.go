@@ -0,0 +1,14 @@
+package backup
+
+import "syscall"
+
+const (
+	errorSharingViolation syscall.Errno = 32 // ERROR_SHARING_VIOLATION
+	errorLockViolation    syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// isRetryableErrno reports whether a Windows specific error is transient.
+// Files opened by another process, like a sync client, can't be replaced until it's done.
+func isRetryableErrno(errno syscall.Errno) bool {
+	return errno == errorSharingViolation || errno == errorLockViolation
+}
@@ -0,0 +1,50 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// invalidNameChars can't be used in file names on Windows filesystems like NTFS and exFAT.
+// A backslash is a path separator on Windows, so it only needs replacing elsewhere.
+var invalidNameChars = func() string {
+	chars := `<>:"|?*`
+	if filepath.Separator != '\\' {
+		chars += `\`
+	}
+
+	return chars
+}()
+
+// sanitizedNameChar replaces the invalid characters via "--sanitize-names"
+const sanitizedNameChar = '_'
+
+// sanitizeRelPath replaces the characters of every path element that are invalid on Windows filesystems,
+// along with the trailing dots and spaces that are silently dropped there.
+func sanitizeRelPath(relPath string) string {
+	names := strings.Split(relPath, string(filepath.Separator))
+
+	for i, name := range names {
+		name = strings.Map(func(r rune) rune {
+			if r < 0x20 || strings.ContainsRune(invalidNameChars, r) {
+				return sanitizedNameChar
+			}
+
+			return r
+		}, name)
+
+		trimmedName := strings.TrimRight(name, ". ")
+		if trimmedName != name && name != "." && name != ".." {
+			name = trimmedName + strings.Repeat(string(sanitizedNameChar), len(name)-len(trimmedName))
+		}
+
+		names[i] = name
+	}
+
+	return strings.Join(names, string(filepath.Separator))
+}
+
+// hasInvalidNameChars reports whether a path can't be created as is on Windows filesystems
+func hasInvalidNameChars(relPath string) bool {
+	return sanitizeRelPath(relPath) != relPath
+}
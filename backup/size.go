@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize converts a human-readable size like "100MB" to bytes. Units are powers of 1024.
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	numberEnd := strings.LastIndexAny(value, "0123456789.") + 1
+	number, unit := value[:numberEnd], strings.TrimSpace(value[numberEnd:])
+
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+
+	exponent := 0
+	if unit != "" {
+		exponent = strings.Index("KMGTPE", unit) + 1
+
+		if len(unit) > 1 || exponent == 0 {
+			return 0, fmt.Errorf("invalid size unit in %q", value)
+		}
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	for range exponent {
+		size *= 1024
+	}
+
+	return int64(size), nil
+}
+
+// FormatSize returns a human-readable size like "1.2 GB"
+func FormatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	divisor, exponent := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		divisor *= unit
+		exponent++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(divisor), "KMGTPE"[exponent])
+}
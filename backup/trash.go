@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trashTimeLayout names the trash folder of each run after its start time
+const trashTimeLayout = "2006-01-02T15-04-05"
+
+// cleanTrash removes the trash folders of the runs older than the retention window
+func cleanTrash(trashDirPath string, retention time.Duration) error {
+	entries, err := os.ReadDir(trashDirPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		runTime, err := time.ParseInLocation(trashTimeLayout, entry.Name(), time.Local)
+
+		// Anything else in the trash dir wasn't put there by a run, so it's left alone
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+
+		if time.Since(runTime) > retention {
+			if err := os.RemoveAll(filepath.Join(trashDirPath, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// moveToTrash moves a removed backup file into the trash folder of this run, keeping its path relative to the backup dir
+func (run *backupRun) moveToTrash(backupFileRelPath, trashRunDirPath string) error {
+	srcPath := filepath.Join(run.config.BackupDir, backupFileRelPath)
+	dstPath := filepath.Join(trashRunDirPath, backupFileRelPath)
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(srcPath, dstPath); err == nil {
+		return nil
+	}
+
+	// Renaming fails when the trash dir is on another device, so the file is copied over instead
+	if err := run.copyFileAsIs(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	return os.Remove(srcPath)
+}
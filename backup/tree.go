@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// plannedChange is a file that a dry run would copy or remove, collected to be printed as a tree
+type plannedChange struct {
+	marker  string // "+" for a new file, "~" for a changed file and "-" for a removed file
+	relPath string // Backup relative path, starting with the project name. A dir ends with a separator.
+}
+
+// printChangeTree prints the planned changes as an indented directory tree, grouped by project as the top level dirs.
+// A dir is printed once before its first change, so the siblings of the changed files don't clutter the tree.
+func (run *backupRun) printChangeTree(changes []plannedChange) {
+	parts := make([][]string, len(changes))
+	for i, change := range changes {
+		parts[i] = strings.Split(strings.TrimSuffix(filepath.ToSlash(change.relPath), "/"), "/")
+	}
+
+	order := make([]int, len(changes))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return slices.Compare(parts[a], parts[b])
+	})
+
+	var printedDirs []string
+
+	for _, i := range order {
+		dirs, name := parts[i][:len(parts[i])-1], parts[i][len(parts[i])-1]
+
+		commonDepth := 0
+		for commonDepth < len(dirs) && commonDepth < len(printedDirs) && dirs[commonDepth] == printedDirs[commonDepth] {
+			commonDepth++
+		}
+
+		for depth := commonDepth; depth < len(dirs); depth++ {
+			run.logInfo(strings.Repeat("  ", depth) + dirs[depth] + "/")
+		}
+		printedDirs = dirs
+
+		if strings.HasSuffix(filepath.ToSlash(changes[i].relPath), "/") {
+			name += "/"
+		}
+
+		run.logInfo(strings.Repeat("  ", len(dirs)) + changes[i].marker + " " + name)
+	}
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// walkBackupDir lists the files and dirs in the backup dir relative to it, except the internal ones of the tool.
+// A large backup on a network drive is dominated by the latency of each dir read, so the dirs are read by up to [Config.Jobs] goroutines.
+// The dirs are listed in the same order as [filepath.WalkDir] lists them, starting with the backup dir itself as ".".
+func (run *backupRun) walkBackupDir() (fileRelPaths map[string]struct{}, dirRelPaths []string, err error) {
+	// Like filepath.WalkDir, a symlinked backup dir isn't followed
+	rootInfo, err := os.Lstat(run.config.BackupDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileRelPaths = make(map[string]struct{})
+	if !rootInfo.IsDir() {
+		fileRelPaths["."] = struct{}{}
+		return fileRelPaths, []string{}, nil
+	}
+
+	dirRelPaths = []string{"."}
+
+	var (
+		mutex    sync.Mutex
+		firstErr error
+		dirs     sync.WaitGroup
+	)
+
+	readers := make(chan struct{}, run.config.Jobs)
+
+	var walkDir func(dirRelPath string)
+	walkDir = func(dirRelPath string) {
+		defer dirs.Done()
+
+		readers <- struct{}{}
+		entries, err := os.ReadDir(filepath.Join(run.config.BackupDir, dirRelPath))
+		<-readers
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if firstErr != nil {
+			return
+		}
+		if err != nil {
+			firstErr = err
+			return
+		}
+
+		for _, entry := range entries {
+			entryRelPath := filepath.Join(dirRelPath, entry.Name())
+
+			// The files of the tool itself must never be removed as stale backup files
+			if run.isInternalPath(filepath.Join(run.config.BackupDir, entryRelPath)) {
+				continue
+			}
+
+			if entry.IsDir() {
+				dirRelPaths = append(dirRelPaths, entryRelPath)
+
+				dirs.Add(1)
+				go walkDir(entryRelPath)
+			} else {
+				fileRelPaths[entryRelPath] = struct{}{}
+			}
+		}
+	}
+
+	dirs.Add(1)
+	walkDir(".")
+	dirs.Wait()
+
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+
+	// The dirs are read in any order, so they are sorted back into the lexical order of a walk, each dir before its children
+	slices.SortFunc(dirRelPaths[1:], func(a, b string) int {
+		return slices.Compare(strings.Split(a, string(filepath.Separator)), strings.Split(b, string(filepath.Separator)))
+	})
+
+	return fileRelPaths, dirRelPaths, nil
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newSyntheticTree creates a backup dir of width dirs nested depth levels deep, each with width files, along with the internal files
+func newSyntheticTree(t testing.TB, width, depth int) string {
+	t.Helper()
+
+	backupDirPath := t.TempDir()
+
+	var createDir func(dirPath string, level int)
+	createDir = func(dirPath string, level int) {
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range width {
+			if err := os.WriteFile(filepath.Join(dirPath, fmt.Sprintf("file-%d.txt", i)), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if level < depth {
+			for i := range width {
+				createDir(filepath.Join(dirPath, fmt.Sprintf("dir-%d", i)), level+1)
+			}
+		}
+	}
+	createDir(backupDirPath, 1)
+
+	for _, fileName := range []string{manifestFileName, journalFileName, checksumsFileName} {
+		writeTestFile(t, filepath.Join(backupDirPath, fileName), "internal")
+	}
+	writeTestFile(t, filepath.Join(backupDirPath, objectsDirName, "00", "object"), "internal")
+
+	return backupDirPath
+}
+
+// walkSequentially lists the backup dir like [backupRun.walkBackupDir] with [filepath.WalkDir]
+func walkSequentially(run *backupRun) (fileRelPaths map[string]struct{}, dirRelPaths []string, err error) {
+	fileRelPaths = make(map[string]struct{})
+
+	err = filepath.WalkDir(run.config.BackupDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if run.isInternalPath(path) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		relPath, err := filepath.Rel(run.config.BackupDir, path)
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			dirRelPaths = append(dirRelPaths, relPath)
+		} else {
+			fileRelPaths[relPath] = struct{}{}
+		}
+
+		return nil
+	})
+
+	return fileRelPaths, dirRelPaths, err
+}
+
+func TestWalkBackupDirMatchesWalkDir(t *testing.T) {
+	run := newBackupRun(Config{BackupDir: newSyntheticTree(t, 4, 3), Jobs: 8, Quiet: true})
+
+	fileRelPaths, dirRelPaths, err := run.walkBackupDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFileRelPaths, wantDirRelPaths, err := walkSequentially(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fileRelPaths) != len(wantFileRelPaths) {
+		t.Errorf("%d files are listed, want %d", len(fileRelPaths), len(wantFileRelPaths))
+	}
+	for relPath := range wantFileRelPaths {
+		if _, ok := fileRelPaths[relPath]; !ok {
+			t.Errorf("%s isn't listed", relPath)
+		}
+	}
+
+	// The empty dirs are pruned deepest first by iterating the dirs backwards, so their order matters too
+	if !slices.Equal(dirRelPaths, wantDirRelPaths) {
+		t.Errorf("dirs are listed as %q, want %q", dirRelPaths, wantDirRelPaths)
+	}
+}
+
+// BenchmarkWalkBackupDir compares the concurrent walk of a backup with about 100k files against a sequential one.
+// A local disk reads a dir in microseconds, so the concurrency only pays off with the latency of a network drive.
+func BenchmarkWalkBackupDir(b *testing.B) {
+	run := newBackupRun(Config{BackupDir: newSyntheticTree(b, 10, 5), Jobs: 8, Quiet: true})
+
+	walks := map[string]func(run *backupRun) (map[string]struct{}, []string, error){
+		"concurrent": (*backupRun).walkBackupDir,
+		"sequential": walkSequentially,
+	}
+
+	for name, walk := range walks {
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				if _, _, err := walk(run); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// config holds the flag values that can be stored in a JSON config file
+type config struct {
+	ProjectsDir  stringList `json:"projects_dir"`
+	BackupDir    string     `json:"backup_dir"`
+	RemoteBranch string     `json:"remote_branch"`
+	ForceInclude []string   `json:"force_include"`
+	Jobs         int        `json:"jobs"`
+}
+
+// defaultConfigPath returns the config file loaded when "--config" isn't given, like "~/.config/git-local-backup/config.json".
+// XDG_CONFIG_HOME is respected on every OS, otherwise it's in the config dir of the OS, like "%AppData%" on Windows.
+func defaultConfigPath() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if !filepath.IsAbs(configDir) {
+		var err error
+		if configDir, err = os.UserConfigDir(); err != nil {
+			return ""
+		}
+	}
+
+	return filepath.Join(configDir, "git-local-backup", "config.json")
+}
+
+// loadConfig reads the config file and applies its values to the flags that weren't passed on the command line
+func loadConfig(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cfg config
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return err
+	}
+
+	passedFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		passedFlags[f.Name] = true
+	})
+
+	values := map[string][]string{
+		"projects-dir":  cfg.ProjectsDir,
+		"backup-dir":    {cfg.BackupDir},
+		"remote-branch": {cfg.RemoteBranch},
+		"force-include": cfg.ForceInclude,
+	}
+
+	if cfg.Jobs != 0 {
+		values["jobs"] = []string{strconv.Itoa(cfg.Jobs)}
+	}
+
+	for name, flagValues := range values {
+		if passedFlags[name] {
+			continue
+		}
+
+		for _, value := range flagValues {
+			if value == "" {
+				continue
+			}
+
+			// Setting through the flag package keeps the parsing identical to the command line
+			if err := flag.Set(name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// stringList accepts either a single string or an array of strings in JSON
+type stringList []string
+
+func (list *stringList) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*list = stringList{value}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(list))
+}
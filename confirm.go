@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// isInteractiveStdin reports whether stdin is a terminal that a user can answer a prompt from
+func isInteractiveStdin() bool {
+	info, err := os.Stdin.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmRemovals lists the files about to be removed from the backup and asks the user to confirm on stdin.
+// Anything other than "y" or "yes", including the end of input or closing the stop channel, declines.
+func confirmRemovals(relPaths []string, stop <-chan struct{}) bool {
+	fmt.Println()
+	for _, relPath := range relPaths {
+		fmt.Println("-", relPath)
+	}
+	fmt.Printf("\nRemove these %d files no longer in the projects from the backup? [y/N] ", len(relPaths))
+
+	// Reading stdin can't be canceled, so an interrupt leaves the read behind instead of waiting for an answer
+	answers := make(chan string, 1)
+	go func() {
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answers <- answer
+	}()
+
+	select {
+	case answer := <-answers:
+		answer = strings.ToLower(strings.TrimSpace(answer))
+
+		return answer == "y" || answer == "yes"
+	case <-stop:
+		fmt.Println()
+
+		return false
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// duration is a flag of a [time.Duration] that also accepts days like "7d"
+type duration time.Duration
+
+func (d *duration) String() string {
+	if *d == 0 {
+		return ""
+	}
+
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(value string) error {
+	parsed, err := parseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+
+	return nil
+}
+
+// parseDuration works like [time.ParseDuration] with the additional support of whole days like "7d"
+func parseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		dayCount, err := strconv.Atoi(days)
+		if err == nil {
+			return time.Duration(dayCount) * 24 * time.Hour, nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// readForceIncludeFile reads the force-include entries listed one per line in a file, like a shared list of a team.
+// Blank lines and the lines starting with "#" are skipped. The entries are relative to each project, so they are kept as is.
+func readForceIncludeFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entries = append(entries, line)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// stopOnInterrupt returns a channel that is closed on the first interrupt or termination signal,
+// so that the run records the completed copies before exiting. The second signal exits immediately as usual.
+func stopOnInterrupt() <-chan struct{} {
+	stop := make(chan struct{})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		signal.Stop(signals)
+
+		logError("Interrupted, finishing the copies in progress. Interrupt again to exit immediately.")
+		close(stop)
+	}()
+
+	return stop
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runLog is the persistent log of "--log-file", if given
+var runLog *rotatingLog
+
+// rotatingLog is an append-only log file. Once it grows past its max size, it's moved to "<path>.1", replacing the older one.
+// Each line is written in a single call under its mutex, so the lines of the concurrent workers never interleave.
+type rotatingLog struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func openRotatingLog(path string, maxSize int64) (*rotatingLog, error) {
+	log := &rotatingLog{path: path, maxSize: maxSize}
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func (log *rotatingLog) open() error {
+	file, err := os.OpenFile(log.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	log.file, log.size = file, info.Size()
+
+	return nil
+}
+
+func (log *rotatingLog) Write(p []byte) (int, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if log.maxSize > 0 && log.size > 0 && log.size+int64(len(p)) > log.maxSize {
+		if err := log.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := log.file.Write(p)
+	log.size += int64(n)
+
+	return n, err
+}
+
+func (log *rotatingLog) rotate() error {
+	log.file.Close()
+
+	if err := os.Rename(log.path, log.path+".1"); err != nil {
+		return err
+	}
+
+	return log.open()
+}
+
+func (log *rotatingLog) Close() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	return log.file.Close()
+}
+
+// writeRunLog appends a timestamped line of the level, like "INFO", to the log file, if given.
+// A broken log doesn't fail the backup itself, so the write errors are ignored.
+func writeRunLog(level string, a ...any) {
+	message := strings.TrimSpace(fmt.Sprintln(a...))
+	if runLog == nil || message == "" {
+		return
+	}
+
+	fmt.Fprintf(runLog, "%s %-5s %s\n", time.Now().Format(time.RFC3339), level, message)
+}
@@ -1,43 +1,177 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ni554n/git-local-backup/backup"
 )
 
 //#region Define CLI flags
 
-type forceIncludedFiles []string
+// pathList is a flag that can be specified multiple times to collect multiple paths or patterns
+type pathList []string
 
-func (fileNames *forceIncludedFiles) String() string {
+func (fileNames *pathList) String() string {
 	return fmt.Sprintf("%s", *fileNames)
 }
 
-func (fileNames *forceIncludedFiles) Set(value string) error {
+func (fileNames *pathList) Set(value string) error {
 	*fileNames = append(*fileNames, filepath.FromSlash(value))
 
 	return nil
 }
 
+// negatedBool is a "--no-" flag that disables a bool flag enabled by default, sharing its value
+type negatedBool struct {
+	value *bool
+}
+
+func (negated negatedBool) String() string {
+	if negated.value == nil {
+		return "false"
+	}
+
+	return strconv.FormatBool(!*negated.value)
+}
+
+func (negated negatedBool) Set(value string) error {
+	isSet, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+
+	*negated.value = !isSet
+
+	return nil
+}
+
+func (negated negatedBool) IsBoolFlag() bool {
+	return true
+}
+
 var (
-	projectsPath          = flag.String("projects-dir", "", "Path to the projects directory (required)")
-	backupPath            = flag.String("backup-dir", "", "Path to an empty backup directory (required)\nOtherwise, existing files may be removed from that directory.")
-	remoteBranch          = flag.String("remote-branch", "origin", "Remote name")
+	backupPath            = flag.String("backup-dir", "", "Path to an empty backup directory (required unless \"--archive\" is given)\nOtherwise, existing files may be removed from that directory. It's created if it doesn't exist.")
+	archivePath           = flag.String("archive", "", "Write the backed up files into a fresh tar archive at this `path` on each run instead of a backup directory.\nIt's gzip compressed if the name ends with \".gz\" or \".tgz\". Restoring from it needs the same flag.")
+	remoteBranch          = flag.String("remote-branch", "origin", "Remote name, used for the branches without a configured upstream.\nA project without this remote uses its \"remote.pushDefault\" or its only remote instead.")
+	plainDirPrefix        = flag.String("plain-dir-prefix", "plain", "Back up the \"--plain-dir\" directories into this `directory` of the backup directory")
+	projectsFilePath      = flag.String("projects-file", "", "Back up the git projects listed one per line in this `file`, or in stdin if it's \"-\".\nEach project is backed up under its directory name. Relative paths are resolved against the directory of the file.")
+	forceIncludeFilePath  = flag.String("force-include-file", "", "Force-include the entries listed one per line in this `file`, along with the \"--force-include\" flags.\nBlank lines and the lines starting with \"#\" are skipped.")
+	gitBinary             = flag.String("git-binary", "", "Path of the git `executable`, for schedulers running with a stripped PATH.\nDefaults to the GIT_LOCAL_BACKUP_GIT environment variable, otherwise the git in PATH.")
+	createBackupDir       = flag.Bool("create-backup-dir", true, "Create the backup directory if it doesn't exist.\nDisable it to fail instead, like when the backup drive isn't mounted.")
+	configPath            = flag.String("config", "", "Path to a JSON config file with the default flag values.\nDefaults to \"git-local-backup/config.json\" in $XDG_CONFIG_HOME or the config directory of the OS, if it exists. Flags passed on the command line take precedence.")
+	showVersion           = flag.Bool("version", false, "Print the version, the git commit and the build date of this binary, then exit")
+	versionFormat         = flag.String("version-format", "text", "Print \"--version\" in this `format`, \"text\" or \"json\" for the monitoring setups")
+	reportPath            = flag.String("report", "", "Write a JSON summary of the run to this `path`")
+	logFilePath           = flag.String("log-file", "", "Append the output of every run with timestamps and levels like INFO, WARN and ERROR to this `path`, regardless of \"--quiet\"")
+	logMaxSize            = byteSize(10 << 20)
+	eventsPath            = flag.String("json-events", "", "Stream every step of the run as a JSON line to this `path`, like a file, a named pipe or \"/dev/fd/3\".\nThe events are scan-start, file-copied, file-removed, project-done and run-complete.")
+	notifyWebhookURL      = flag.String("notify-webhook", "", "POST a JSON summary with the errors to this `URL` when the run fails")
+	notifyAlways          = flag.Bool("notify-always", false, "Notify the webhook after every run, not only the failed ones")
+	preHook               = flag.String("pre-hook", "", "Run this shell `command` before the backup, like mounting the backup drive.\nThe backup is skipped if it fails.")
+	postHook              = flag.String("post-hook", "", "Run this shell `command` after the backup, even if it fails, like unmounting the backup drive.\nThe exit code of the backup is passed in the GIT_LOCAL_BACKUP_EXIT_CODE environment variable.")
+	showStats             = flag.Bool("stats", false, "Print a table of the backed up files, size and scan time of each project, largest first")
+	showProgress          = flag.Bool("progress", false, "Show the progress of the copied bytes on stderr")
+	verbose               = flag.Bool("verbose", false, "Print every file that is copied, skipped or removed along with the reason")
+	quiet                 = flag.Bool("quiet", false, "Print only the errors and the final summary")
+	check                 = flag.Bool("check", false, "Verify that the backup is current without modifying it.\nReports the files missing from the backup, differing by content or no longer in the projects, and exits with 1 if there are any.")
 	dryRun                = flag.Bool("dry-run", false, "Preview changes without modifying the backup directory")
-	forceIncludedRelPaths forceIncludedFiles
+	interactive           = flag.Bool("interactive", false, "List the files no longer in the projects and ask for a confirmation before removing them from the backup.\nOnly asks if stdin is a terminal, otherwise they are removed as usual.")
+	assumeYes             = flag.Bool("yes", false, "Remove the files no longer in the projects without asking, even with \"--interactive\"")
+	outputFormat          = flag.String("output-format", "flat", "List the planned changes of \"--dry-run\" and \"--check\" in this `format`.\n\"flat\" prints a line per file for scripting, \"tree\" prints an indented directory tree grouped by project with +, ~ and - markers.")
+	showDiff              = flag.Int("show-diff", 0, "Print up to this many `lines` of the unified diff of each changed file with \"--dry-run\" or \"--check\", like \"20\"\nHelps auditing what the backup is about to capture. Only the flat output format shows the diffs.")
+	restore               = flag.Bool("restore", false, "Copy the backed up files back into the projects directory.\nExisting project files are never overwritten unless \"--force\" is also given.")
+	force                 = flag.Bool("force", false, "Overwrite existing project files while restoring")
+	trashPath             = flag.String("trash-dir", "", "Move the files removed from the backup into a timestamped folder of this `directory` instead of deleting them")
+	trashRetention        = duration(7 * 24 * time.Hour)
+	logRemovals           = flag.Bool("removal-log", false, "Append every file removed from the backup with a timestamp to \".git-backup-removed.log\" in the backup directory")
+	deleteRemoved         = flag.Bool("delete", true, "Remove the files no longer in the projects from the backup, mirroring the projects.\nDisable it for an append-only backup that keeps every deleted file recoverable.")
+	pruneEmptyDirs        = flag.Bool("prune-empty-dirs", true, "Remove the backup directories that became empty after removing the files no longer in the projects.\nDisable it to keep a stable directory structure.")
+	forceUnlock           = flag.Bool("force-unlock", false, "Run even if the backup directory is locked by another backup")
+	recursive             = flag.Bool("recursive", false, "Search for git projects in the nested directories of the projects directory")
+	warnNonGit            = flag.Bool("warn-non-git", false, "Warn about the directories of the projects directory that aren't git projects, like a repository whose \".git\" got deleted.\nThey are only listed with \"--verbose\" otherwise.")
+	fsync                 = flag.Bool("fsync", false, "Flush every copied file to the disk before moving on.\nSafer on external or cloud-synced drives, but slows down large backups considerably.")
+	compress              = flag.String("compress", "", "Compress every backed up file with this `algorithm`, adding its extension to the file name.\nOnly \"gzip\" is supported. Restoring a compressed backup needs the same flag.")
+	sanitizeNames         = flag.Bool("sanitize-names", false, "Replace the characters in the backup file names that are invalid on Windows filesystems like exFAT and NTFS.\nThe original names are recorded in the manifest, so restoring brings them back.")
+	layout                = flag.String("layout", "project-name", "Name the top-level backup directory of each project after this `layout`.\n\"project-name\" uses the project directory name, \"remote-name\" the repository name in its remote URL, and \"source-path\" mirrors the full project path like \"home/user/Projects/app\".")
+	flatten               = flag.Bool("flatten", false, "Back up the project files directly in the backup directory, named like \"project__path__to__file\".\nThe original paths are recorded in the manifest, so restoring brings them back. Restoring a flattened backup needs the same flag.")
+	caseInsensitive       = flag.Bool("case-insensitive-target", false, "Treat the backup filesystem as case-insensitive without detecting it.\nFiles differing only by case, like \"README.md\" and \"Readme.md\", are reported instead of overwriting each other.")
+	hardlink              = flag.Bool("hardlink", false, "Hardlink the files into the backup instead of copying them, if both are on the same filesystem.\nA hardlinked backup shares the content with the project file, so editing the project file changes the backup too.")
+	dedup                 = flag.Bool("dedup", false, "Store each distinct file content once in \".git-backup-objects\" of the backup directory, and hardlink the backed up files to it.\nA small pointer file is written instead if the filesystem doesn't support hardlinks, which restoring resolves.")
+	overwriteOnlyIfNewer  = flag.Bool("overwrite-only-if-newer", false, "Keep a changed file in the backup, with a warning, if it was modified after its source, like when it's edited in the backup directly")
+	compareMode           = flag.String("compare-mode", "hash", "Compare the backed up files whose modification time differs from their source in this `mode`.\n\"hash\" compares the digests of the same-sized files, \"quick\" copies them again without reading, and \"git\" compares them via \"git diff --no-index\".")
+	verify                = flag.Bool("verify", false, "Re-read every copied file and compare its checksum with the source.\nMismatched files are copied once more before being reported as failed.")
+	checksums             = flag.Bool("checksums", false, "Write the SHA-256 digests of the backed up files into \"SHA256SUMS\" of the backup directory on each run.\nThe backup can be verified later with \"sha256sum -c SHA256SUMS\" from the backup directory. Can't be combined with \"--compress\".")
+	retries               = flag.Int("retries", 3, "Retry the transient copy failures like a file locked by a sync client this many times.\nThe wait between the retries starts from 500ms and doubles each time.")
+	jobs                  = flag.Int("jobs", runtime.NumCPU(), "Number of projects to scan and files to copy concurrently")
+	projectsPaths         pathList
+	plainDirPaths         pathList
+	forceIncludedRelPaths pathList
+	forceIncludeGitignore = flag.Bool("force-include-gitignore", false, "Skip the git ignored files inside the force-included directories.\nIf a force-included directory is ignored itself, everything inside it is skipped as well.")
+	copyEmptyDirs         = flag.Bool("copy-empty-dirs", false, "Create the empty directories inside the force-included directories in the backup too, and never prune them.\nPreserves the expected project scaffolding, like an empty \"logs\" or \"uploads\" directory.")
+	excludedPatterns      pathList
+	gitSubpaths           pathList
+	includedIgnored       pathList
+	excludedProjects      pathList
+	selectedProjects      pathList
+	includeCommitPatches  = flag.Bool("include-commit-patches", false, "Export the unpushed commits of each project as patch files into \".git-backup/patches\" of its backup.\nThey can be applied back with \"git am\".")
+	allBranches           = flag.Bool("all-branches", false, "Export the unpushed commits of every other local branch as patch files into \".git-backup/branches/<branch>\" of each project's backup.\nThe branches aren't checked out, so only their commits are backed up.")
+	includeTags           = flag.Bool("include-tags", false, "Export the tags pointing to the commits that aren't on any remote into \".git-backup/tags\" of each project's backup.\nCombine it with \"--include-commit-patches\" to recover the tagged commits as well.")
+	maxFileSize           byteSize
+	maxTotalSize          byteSize
+	compressMinSize       byteSize
+	rateLimit             byteRate
+	since                 duration
+	timeBudget            duration
+	failFast              = flag.Bool("fail-fast", false, "Stop at the first failed project or file instead of backing up the rest.\nNothing is removed from the backup after an error, and the unfinished projects and files are left for the next run.")
+	newerThanBackup       = flag.Bool("newer-than-backup", false, "Skip running git for the projects with no file modified since their last backup.\nSpeeds up the runs over many idle projects, but the projects aren't rescanned after changing the other flags until a file changes.")
+	forceScan             = flag.Bool("force-scan", false, "Scan every project even with \"--newer-than-backup\", like after changing the other flags")
+	includeUntracked      = flag.Bool("untracked", true, "Back up the files that are not yet tracked by \"git add\"")
+	excludeStandard       = flag.Bool("exclude-standard", true, "Skip the untracked files ignored by \".gitignore\", \".git/info/exclude\" and the global excludes.\nDisable it to back up every untracked file instead, including the dependencies and build outputs like \"node_modules\", which can be huge.")
+	includeUnstaged       = flag.Bool("unstaged", true, "Back up the working tree changes that are not yet staged")
+	includeStaged         = flag.Bool("staged", true, "Back up the staged changes that are not yet committed")
+	includeUnpushed       = flag.Bool("unpushed", true, "Back up the files changed in the local commits that are not yet pushed to the remote")
+	includeSubmodules     = flag.Bool("include-submodules", false, "Back up the untracked, changed and unpushed files of the submodules recursively")
+	includeStashes        = flag.Bool("include-stashes", false, "Export the stashes of each project as patch files into \".git-backup/stashes\" of its backup")
 )
 
 func init() {
-	flag.Var(&forceIncludedRelPaths, "force-include", "Always include a git ignored `file/directory` like \".git\".\nCan be specified multiple times to include multiple items.")
+	flag.Var(&projectsPaths, "projects-dir", "Path to the projects `directory` (required unless \"--projects-file\" is given)\nCan be specified multiple times to back up the projects of multiple directories.")
+	flag.Var(&plainDirPaths, "plain-dir", "Back up every file of this `directory` without git, like \"~/Documents/notes\", respecting \"--exclude\".\nIt's backed up under its name inside \"--plain-dir-prefix\". Can be specified multiple times.")
+	flag.Var(&forceIncludedRelPaths, "force-include", "Always include a git ignored `file/directory` like \".git\", or the ones matching a glob pattern like \"**/.env\".\nCan be specified multiple times to include multiple items.")
+	flag.Var(&timeBudget, "time-budget", "Stop scanning new projects and copying new files after this `duration` like \"10m\" (default unlimited)\nThe files being copied are finished, and the rest is left for the next run.")
+	flag.Var(&since, "since", "Only copy the files modified within this `duration` like \"24h\" or \"7d\"")
+	flag.Var(&logMaxSize, "log-max-size", "Move the log file to \"<path>.1\" once it grows past this `size`, replacing the previous one")
+	flag.Var(&compressMinSize, "compress-min-size", "Store the files smaller than this `size` like \"64KB\" uncompressed with \"--compress\", as compressing tiny files saves little")
+	flag.Var(&maxFileSize, "max-file-size", "Skip the files larger than this `size` like \"100MB\" (default unlimited)")
+	flag.Var(&maxTotalSize, "max-total-size", "Keep the total size of the backed up files under this `size` like \"2GB\", leaving out the least recently modified files that don't fit (default unlimited)\nThe existing backups of the left out files are kept, so they still count until they are removed from the projects.")
+	flag.Var(&selectedProjects, "project", "Only back up the project with this `name`, which is its relative path in recursive mode.\nThe backups of the other projects are kept as is. Can be specified multiple times.")
+	flag.Var(&excludedProjects, "exclude-project", "Skip the projects whose relative path matches a glob `pattern` like \"mirrors/*\".\nThe existing backup of a skipped project is kept as is. Can be specified multiple times.")
+	flag.Var(&trashRetention, "trash-retention", "Delete the trash folders older than this `duration` like \"7d\" at the start of each run")
+	flag.Var(&rateLimit, "rate-limit", "Limit the total copy throughput of all the jobs to this `rate` like \"10MB/s\" (default unlimited)")
+	flag.Var(&includedIgnored, "include-ignored", "Back up the git ignored files matching a glob `pattern` like \".env\" or \"config/*.local.json\".\nOnly the files git lists as ignored are matched, unlike \"--no-exclude-standard\" backing up every ignored file. Can be specified multiple times.")
+	flag.Var(&gitSubpaths, "include-git-subpath", "Back up a `file/directory` inside the git dir like \".git/config\" or \".git/hooks\".\nThe objects are never included. Can be specified multiple times.")
+	flag.Var(negatedBool{excludeStandard}, "no-exclude-standard", "Back up every untracked file, including the git ignored ones, same as \"--exclude-standard=false\".\nThat includes the dependencies and build outputs like \"node_modules\", which can be huge, so try it with \"--dry-run\" first.")
+	flag.Var(negatedBool{deleteRemoved}, "no-delete", "Keep the files no longer in the projects in the backup, making it append-only, same as \"--delete=false\"")
+	flag.Var(negatedBool{createBackupDir}, "no-create", "Fail if the backup directory doesn't exist, same as \"--create-backup-dir=false\"")
+	flag.BoolVar(newerThanBackup, "only-changed-projects", false, "Alias of \"--newer-than-backup\"")
+	flag.BoolVar(pruneEmptyDirs, "prune-empty-projects", true, "Alias of \"--prune-empty-dirs\"")
+	flag.Var(&excludedPatterns, "exclude", "Never back up the files matching a glob `pattern` like \"*.log\" or \"logs/**/*.txt\".\nPatterns without a \"/\" match at any depth. Can be specified multiple times.")
 
 	flag.Usage = func() {
-		message := `Git Local Backup v1.0
+		message := `Git Local Backup %v
 
 A tool for copying local files from Git projects to a cloud drive or a backup disk for safekeeping.
 It copies only the files that have been modified since the last backup, including:
@@ -49,6 +183,8 @@ It copies only the files that have been modified since the last backup, includin
   … basically every unpushed file that can be lost during an incident.
 
 Usage: %v [FLAGS] --projects-dir "<path>" --backup-dir "<path>"
+       %v [FLAGS] --projects-file "<path>" --backup-dir "<path>"
+       %v [FLAGS] --projects-dir "<path>" --archive "<path>"
 
 > Use either - or -- for flags. They are equivalent.
 
@@ -56,7 +192,7 @@ Flags:
 
 `
 		w := flag.CommandLine.Output()
-		fmt.Fprintf(w, message, filepath.Base(os.Args[0]))
+		fmt.Fprintf(w, message, currentBuildInfo().Version, filepath.Base(os.Args[0]), filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 		fmt.Fprintf(w, "\nVisit https://github.com/ni554n/git-local-backup for scheduling instructions.\n")
 	}
@@ -69,260 +205,399 @@ func main() {
 
 	flag.Parse()
 
-	if *projectsPath == "" || *backupPath == "" {
+	if *showVersion {
+		if *versionFormat != "text" && *versionFormat != "json" {
+			logError(fmt.Sprintf("Unsupported version format %q, use \"text\" or \"json\"", *versionFormat))
+			os.Exit(exitUsage)
+		}
+
+		if err := printVersion(os.Stdout, *versionFormat); err != nil {
+			logError("Failed to print the version:", err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(exitSuccess)
+	}
+
+	if *configPath != "" {
+		if err := loadConfig(expandFlagPath("config", *configPath)); err != nil {
+			logError("Failed to load the config file:", err)
+			os.Exit(exitUsage)
+		}
+	} else if path := defaultConfigPath(); path != "" {
+		// Without a default config, only the flags are used
+		if err := loadConfig(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logError("Failed to load the config file:", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	// Without any flag or config, the usage is more helpful than the first missing option
+	if flag.NFlag() == 0 {
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
-	if strings.HasPrefix(*projectsPath, "~") {
-		homeDir, err := os.UserHomeDir()
-		panicIf(err)
-		*projectsPath = filepath.Join(homeDir, (*projectsPath)[1:])
+	for i := range projectsPaths {
+		projectsPaths[i] = expandFlagPath("projects-dir", projectsPaths[i])
 	}
 
-	if strings.HasPrefix(*backupPath, "~") {
-		homeDir, err := os.UserHomeDir()
-		panicIf(err)
-		*backupPath = filepath.Join(homeDir, (*backupPath)[1:])
+	for i := range plainDirPaths {
+		plainDirPaths[i] = expandFlagPath("plain-dir", plainDirPaths[i])
 	}
 
-	//#endregion Parse flags
+	projectPaths := []string{}
+	if *projectsFilePath != "" {
+		var err error
+		projectPaths, err = readProjectsFile(expandFlagPath("projects-file", *projectsFilePath))
+		if err != nil {
+			logError("Failed to read the projects file:", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *forceIncludeFilePath != "" {
+		entries, err := readForceIncludeFile(expandFlagPath("force-include-file", *forceIncludeFilePath))
+		if err != nil {
+			logError("Failed to read the force-include file:", err)
+			os.Exit(exitUsage)
+		}
+
+		for _, entry := range entries {
+			forceIncludedRelPaths.Set(entry)
+		}
+	}
 
-	// Check if git is installed
-	_, err := exec.LookPath("git")
-	panicIf(err)
+	*backupPath = expandFlagPath("backup-dir", *backupPath)
+	*archivePath = expandFlagPath("archive", *archivePath)
 
-	//#region Read the full backup directory
+	if *gitBinary == "" {
+		*gitBinary = os.Getenv("GIT_LOCAL_BACKUP_GIT")
+	}
 
-	backedUpDirRelPaths := []string{}
+	*gitBinary = expandFlagPath("git-binary", *gitBinary)
+	*reportPath = expandFlagPath("report", *reportPath)
+	*trashPath = expandFlagPath("trash-dir", *trashPath)
+	*eventsPath = expandFlagPath("json-events", *eventsPath)
+
+	cfg := backup.Config{
+		ProjectsDirs:          projectsPaths,
+		PlainDirs:             plainDirPaths,
+		PlainDirsPrefix:       filepath.FromSlash(*plainDirPrefix),
+		ProjectPaths:          projectPaths,
+		BackupDir:             *backupPath,
+		Archive:               *archivePath,
+		Remote:                *remoteBranch,
+		GitBinary:             *gitBinary,
+		Recursive:             *recursive,
+		WarnNonGitDirs:        *warnNonGit,
+		Projects:              selectedProjects,
+		ExcludeProjects:       excludedProjects,
+		Untracked:             *includeUntracked,
+		UntrackedIgnored:      !*excludeStandard,
+		Unstaged:              *includeUnstaged,
+		Staged:                *includeStaged,
+		Unpushed:              *includeUnpushed,
+		IncludeSubmodules:     *includeSubmodules,
+		ForceInclude:          forceIncludedRelPaths,
+		ForceIncludeGitignore: *forceIncludeGitignore,
+		CopyEmptyDirs:         *copyEmptyDirs,
+		Exclude:               excludedPatterns,
+		IncludeStashes:        *includeStashes,
+		IncludeCommitPatches:  *includeCommitPatches,
+		AllBranches:           *allBranches,
+		IncludeTags:           *includeTags,
+		GitSubpaths:           gitSubpaths,
+		IncludeIgnored:        includedIgnored,
+		MaxFileSize:           int64(maxFileSize),
+		MaxTotalSize:          int64(maxTotalSize),
+		Since:                 time.Duration(since),
+		TimeBudget:            time.Duration(timeBudget),
+		FailFast:              *failFast,
+		NewerThanBackup:       *newerThanBackup && !*forceScan,
+		Jobs:                  *jobs,
+		RateLimit:             int64(rateLimit),
+		Compress:              *compress,
+		CompressMinSize:       int64(compressMinSize),
+		SanitizeNames:         *sanitizeNames,
+		Flatten:               *flatten,
+		CaseInsensitiveTarget: *caseInsensitive,
+		Hardlink:              *hardlink,
+		Dedup:                 *dedup,
+		Fsync:                 *fsync,
+		Verify:                *verify,
+		Checksums:             *checksums,
+		OverwriteOnlyIfNewer:  *overwriteOnlyIfNewer,
+		CompareMode:           *compareMode,
+		Retries:               *retries,
+		TrashDir:              *trashPath,
+		TrashRetention:        time.Duration(trashRetention),
+		RemovalLog:            *logRemovals,
+		KeepEmptyDirs:         !*pruneEmptyDirs,
+		KeepRemovedFiles:      !*deleteRemoved,
+		DryRun:                *dryRun,
+		Check:                 *check,
+		OutputFormat:          *outputFormat,
+		Layout:                *layout,
+		ShowDiffLines:         *showDiff,
+		Force:                 *force,
+		ForceUnlock:           *forceUnlock,
+		RequireBackupDir:      !*createBackupDir,
+		Verbose:               *verbose,
+		Quiet:                 *quiet,
+		Progress:              *showProgress,
+	}
 
-	type StringSet map[string]struct{}
-	backedUpFileRelPaths := make(StringSet)
+	// Rejected before anything runs, like the pre-hook, with the reason instead of only the usage
+	if err := cfg.Validate(); err != nil {
+		logError(err)
+		logError("Run with \"--help\" to see every flag.")
+		os.Exit(exitUsage)
+	}
 
-	err = filepath.WalkDir(*backupPath, func(path string, entry fs.DirEntry, err error) error {
+	if *eventsPath != "" {
+		eventsFile, err := os.Create(*eventsPath)
 		if err != nil {
-			return err
+			logError("Failed to open the event stream:", err)
+			os.Exit(exitUsage)
 		}
+		defer eventsFile.Close()
 
-		entryRelPath, err := filepath.Rel(*backupPath, path)
+		cfg.Events = eventsFile
+	}
 
-		if entry.IsDir() {
-			backedUpDirRelPaths = append(backedUpDirRelPaths, entryRelPath)
-		} else {
-			backedUpFileRelPaths[entryRelPath] = struct{}{}
+	if *logFilePath != "" {
+		var err error
+		runLog, err = openRotatingLog(expandFlagPath("log-file", *logFilePath), int64(logMaxSize))
+		if err != nil {
+			logError("Failed to open the log file:", err)
+			os.Exit(exitUsage)
 		}
+		defer runLog.Close()
 
-		return nil
-	})
-	panicIf(err)
+		cfg.Log = runLog
+	}
 
-	//#endregion Read the full backup directory
+	cfg.Stop = stopOnInterrupt()
 
-	//#region Visit each project directory and make a list of files to backup
+	if *interactive && !*assumeYes && isInteractiveStdin() {
+		cfg.ConfirmRemovals = func(relPaths []string) bool {
+			return confirmRemovals(relPaths, cfg.Stop)
+		}
+	}
 
-	projectDirEntries, err := os.ReadDir(*projectsPath)
-	panicIf(err)
+	//#endregion Parse flags
 
-	projectFiles := []string{}
+	// The post-hook runs even if the pre-hook or the run fails, so that it can clean up
+	writeRunLog("INFO", "Run started with version", currentBuildInfo().Version)
 
-	for _, projectDir := range projectDirEntries {
-		if !projectDir.IsDir() {
-			continue
-		}
+	exitCode := exitFatal
+	if err := runHook(*preHook); err != nil {
+		logError("Failed to run the pre-hook:", err)
+		notifyNotStarted(fmt.Errorf("pre-hook failed: %w", err))
+	} else {
+		exitCode = run(cfg)
+	}
 
-		projectDirPath := filepath.Join(*projectsPath, projectDir.Name())
+	if err := runHook(*postHook, "GIT_LOCAL_BACKUP_EXIT_CODE="+strconv.Itoa(exitCode)); err != nil {
+		logError("Failed to run the post-hook:", err)
 
-		// Skip over non-git projects
-		if _, err := os.Stat(filepath.Join(projectDirPath, ".git")); os.IsNotExist(err) {
-			continue
+		if exitCode == exitSuccess {
+			exitCode = exitFailure
 		}
+	}
 
-		// `cd` into the project directory
-		err := os.Chdir(projectDirPath)
-		panicIf(err)
-
-		// --exclude-standard: Ignore .gitignore and other git excluded files
-		// --others: Untracked files not yet added by `git add`
-		// --full-name: Output relative paths
-		untrackedFilesStdout, err := exec.Command(
-			"git", "--no-pager", "ls-files", "--exclude-standard", "--others", "--full-name",
-		).Output()
-		panicIf(err)
-
-		includedFiles := strings.Split(filepath.FromSlash(string(untrackedFilesStdout)), "\n")
-
-		branchNameStdout, err := exec.Command(
-			"git", "--no-pager", "branch", "--show-current",
-		).Output()
-		panicIf(err)
-		branchName := strings.TrimSpace(string(branchNameStdout))
-
-		// Current branch name can be empty when a specific commit is checked out
-		if branchName != "" {
-			// Files that are in local commits but not yet pushed to the remote
-			unpushedFilesStdout, _ := exec.Command(
-				"git", "--no-pager", "diff", "--name-only", *remoteBranch+"/"+branchName,
-			).Output()
-			unpushedFiles := strings.Split(filepath.FromSlash(string(unpushedFilesStdout)), "\n")
-
-			includedFiles = append(includedFiles, unpushedFiles...)
-		}
+	writeRunLog("INFO", "Run finished with exit code", exitCode)
+
+	os.Exit(exitCode)
+}
+
+// Exit codes of the tool, so that a scheduler or a monitor can tell a partial failure from a broken setup
+const (
+	exitSuccess = 0 // Everything was backed up, or the backup is current in check mode
+	exitFailure = 1 // The run completed, but some projects or files failed, or the backup is outdated in check mode
+	exitUsage   = 2 // The flags or the config file are invalid
+	exitFatal   = 3 // The run couldn't start, like when git is missing or the backup dir is inaccessible
+)
+
+// fatalExitCode returns the exit code of an error that stopped the run, telling an invalid config apart from a broken setup
+func fatalExitCode(err error) int {
+	if errors.Is(err, backup.ErrInvalidConfig) {
+		return exitUsage
+	}
+
+	return exitFatal
+}
 
-		for _, forceIncludedRelPath := range forceIncludedRelPaths {
-			forceIncludedPath := filepath.Join(projectDirPath, forceIncludedRelPath)
-
-			info, err := os.Stat(forceIncludedPath)
-			if os.IsNotExist(err) {
-				continue
-			}
-			panicIf(err)
-
-			if info.IsDir() {
-				err = filepath.WalkDir(forceIncludedPath, func(path string, entry fs.DirEntry, err error) error {
-					if err != nil {
-						return err
-					}
-
-					if !entry.IsDir() {
-						entryRelPath, err := filepath.Rel(projectDirPath, path)
-						panicIf(err)
-						includedFiles = append(includedFiles, entryRelPath)
-					}
-
-					return nil
-				})
-				panicIf(err)
-			} else {
-				includedFiles = append(includedFiles, forceIncludedRelPath)
-			}
+// run backs up or restores the projects and prints the summary. It returns the exit code.
+func run(cfg backup.Config) int {
+	if *restore {
+		restoreReport, err := backup.Restore(cfg)
+		if err != nil {
+			logError(err)
+			return fatalExitCode(err)
 		}
 
-		// Add current project dir to the each element in the includedFiles
-		for _, includedFile := range includedFiles {
-			if strings.TrimSpace(includedFile) == "" {
-				continue
-			}
+		logInfo()
+		fmt.Printf("%d files restored, %d existing files skipped\n", restoreReport.FilesRestored, restoreReport.FilesSkipped)
+		writeRunLog("INFO", fmt.Sprintf("%d files restored, %d existing files skipped", restoreReport.FilesRestored, restoreReport.FilesSkipped))
 
-			projectFiles = append(projectFiles, filepath.Join(projectDir.Name(), includedFile))
+		// An interrupted restore is incomplete, even if every file it got to was restored
+		if len(restoreReport.Errors) > 0 || restoreReport.Truncated {
+			return exitFailure
 		}
+
+		return exitSuccess
+	}
+
+	report, err := backup.Run(cfg)
+	if err != nil {
+		logError(err)
+		notifyNotStarted(err)
+
+		return fatalExitCode(err)
 	}
 
-	//#endregion Visit each project directory and make a list of files to backup
+	if *showStats {
+		printStats(report)
+	}
 
-	if *dryRun {
-		fmt.Println("Simulating changes to backup directory:")
-		fmt.Println()
+	summary := ""
+	if *check {
+		summary = fmt.Sprintf("%d files missing from the backup, %d files differ, %d files no longer in the projects\n",
+			report.FilesCopied, report.FilesUpdated, report.FilesRemoved)
+	} else if *dryRun {
+		summary = fmt.Sprintf("%d files to copy (%s), %d files to delete, %d projects scanned\n",
+			report.FilesCopied+report.FilesUpdated, backup.FormatSize(report.BytesCopied), report.FilesRemoved, report.ProjectsScanned)
+	} else {
+		summary = fmt.Sprintf("%d files copied (%s) in %s, %s\n", report.FilesCopied+report.FilesUpdated,
+			backup.FormatSize(report.BytesCopied), report.Duration.Round(time.Millisecond), formatRate(report.BytesCopied, report.Duration))
 	}
+	summary += fmt.Sprintf("%d projects failed, %d succeeded\n", report.ProjectsFailed, report.ProjectsScanned-report.ProjectsFailed)
 
-	//#region Make the necessary changes to the backup directory
+	logInfo()
+	fmt.Print(summary)
 
-	for _, projectFileRelPath := range projectFiles {
-		projectFilePath := filepath.Join(*projectsPath, projectFileRelPath)
+	for _, line := range strings.Split(strings.TrimSpace(summary), "\n") {
+		writeRunLog("INFO", line)
+	}
 
-		// Deleted files can appear in the git change list. Will be removed later.
-		if _, err := os.Stat(projectFilePath); os.IsNotExist(err) {
-			continue
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, report); err != nil {
+			logError("Failed to write the report:", err)
+			return exitFailure
 		}
+	}
 
-		if _, ok := backedUpFileRelPaths[projectFileRelPath]; ok {
-			delete(backedUpFileRelPaths, projectFileRelPath)
+	isOutdated := *check && report.FilesCopied+report.FilesUpdated+report.FilesRemoved > 0
+	isFailed := len(report.Errors) > 0 || isOutdated
 
-			diffStdout, _ := exec.Command(
-				"git", "--no-pager", "diff", "--no-index", "--name-only",
-				projectFilePath,
-				filepath.Join(*backupPath, projectFileRelPath),
-			).Output()
+	// An interrupted run is incomplete, even if everything it got to was backed up
+	select {
+	case <-cfg.Stop:
+		isFailed = true
+	default:
+	}
 
-			// No diff output means the file hasn't changed
-			if len(diffStdout) == 0 {
-				continue
-			}
+	if *notifyWebhookURL != "" && (isFailed || *notifyAlways) {
+		status := "succeeded"
+		if isFailed {
+			status = "failed"
 		}
 
-		// Copy files that are changed or newly added
-		if *dryRun {
-			fmt.Println("+", projectFileRelPath)
-		} else {
-			err := copyFile(projectFilePath, filepath.Join(*backupPath, projectFileRelPath))
-			if err != nil {
-				fmt.Println(err)
-			}
+		if err := notifyWebhook(*notifyWebhookURL, status, strings.TrimSpace(summary), report.Errors, &report); err != nil {
+			logError("Failed to notify the webhook:", err)
+			return exitFailure
 		}
 	}
 
-	// Removing files from backup folder that are no longer in the project
-	for backupFileRelPath := range backedUpFileRelPaths {
-		if *dryRun {
-			fmt.Println("-", backupFileRelPath)
-		} else {
-			err := os.Remove(filepath.Join(*backupPath, backupFileRelPath))
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
+	if isFailed {
+		return exitFailure
 	}
 
-	// Removing empty dirs recursively. Skipping 0th item as it's the backup dir path itself.
-	if !*dryRun {
-		for i := len(backedUpDirRelPaths) - 1; i > 0; i-- {
-			// Attempting to remove every backup dir. If it's not empty then it will fail expectedly.
-			err := os.Remove(filepath.Join(*backupPath, backedUpDirRelPaths[i]))
+	return exitSuccess
+}
 
-			// If the error wasn't due to the dir not being empty then it's a real error.
-			if err != nil && !os.IsNotExist(err) {
-				fmt.Println(err)
-			}
-		}
+// printStats prints a table of the projects in the report, largest backup first
+func printStats(report backup.Report) {
+	projectNames := make([]string, 0, len(report.Projects))
+	for projectName := range report.Projects {
+		projectNames = append(projectNames, projectName)
 	}
 
-	//#endregion Make the necessary changes to the backup directory
-}
-
-func copyFile(srcPath, dstPath string) error {
-	// Create the destination directory if it doesn't exist
-	dstDir := filepath.Dir(dstPath)
-	_, err := os.Stat(dstDir)
-	if err != nil && os.IsNotExist(err) {
-		err := os.MkdirAll(dstDir, 0755)
-		if err != nil {
-			return err
+	slices.SortFunc(projectNames, func(a, b string) int {
+		if sizeOrder := cmp.Compare(report.Projects[b].BytesBackedUp, report.Projects[a].BytesBackedUp); sizeOrder != 0 {
+			return sizeOrder
 		}
+
+		return strings.Compare(a, b)
+	})
+
+	fmt.Println()
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "Project\tFiles\tSize\tCopied\tScan time")
+
+	for _, projectName := range projectNames {
+		projectReport := report.Projects[projectName]
+
+		fmt.Fprintf(table, "%s\t%d\t%s\t%d\t%s\n",
+			projectName,
+			projectReport.FilesBackedUp,
+			backup.FormatSize(projectReport.BytesBackedUp),
+			projectReport.FilesCopied+projectReport.FilesUpdated,
+			projectReport.ScanDuration.Round(time.Millisecond),
+		)
 	}
 
-	// Open the source file for reading
-	sourceFile, err := os.Open(srcPath)
+	table.Flush()
+}
+
+// writeReport saves the report as an indented JSON file
+func writeReport(path string, report backup.Report) error {
+	content, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer sourceFile.Close()
 
-	// Create the destination file if it doesn't exist
-	destinationFile, err := os.Create(dstPath)
-	if err != nil {
-		return err
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// logInfo prints the regular output that is hidden with "--quiet"
+func logInfo(a ...any) {
+	if !*quiet {
+		fmt.Println(a...)
 	}
-	defer destinationFile.Close()
 
-	// Copy the contents of the source file to the destination file
-	_, err = io.Copy(destinationFile, sourceFile)
-	if err != nil {
-		return err
+	writeRunLog("INFO", a...)
+}
+
+// logError prints an error to stderr
+func logError(a ...any) {
+	fmt.Fprintln(os.Stderr, a...)
+	writeRunLog("ERROR", a...)
+}
+
+// expandHomeDir replaces the leading "~" of a path with the user's home directory
+func expandHomeDir(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
 	}
 
-	// Preserve the file permissions of the source file
-	srcInfo, err := os.Stat(srcPath)
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return err
-	}
-	if err := os.Chmod(dstPath, srcInfo.Mode()); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return filepath.Join(homeDir, path[1:]), nil
 }
 
-func panicIf(err error) {
+// expandFlagPath expands the home directory of the path given to the flag, exiting with the usage error if it can't
+func expandFlagPath(flagName, path string) string {
+	expandedPath, err := expandHomeDir(path)
 	if err != nil {
-		panic(err)
+		logError(fmt.Sprintf("Failed to expand the path of \"--%s\": %v", flagName, err))
+		os.Exit(exitUsage)
 	}
+
+	return expandedPath
 }
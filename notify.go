@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ni554n/git-local-backup/backup"
+)
+
+// notifyTimeout keeps a hanging webhook from stalling the exit of a scheduled run
+const notifyTimeout = 10 * time.Second
+
+// notification is the JSON payload posted to the webhook
+type notification struct {
+	Host    string         `json:"host"`
+	Status  string         `json:"status"` // "succeeded" or "failed"
+	Summary string         `json:"summary"`
+	Errors  []string       `json:"errors"`
+	Report  *backup.Report `json:"report,omitempty"` // Missing if the run couldn't start
+}
+
+// notifyNotStarted notifies the webhook, if any, about a run that couldn't start, like when the pre-hook fails
+func notifyNotStarted(err error) {
+	if *notifyWebhookURL == "" {
+		return
+	}
+
+	if err := notifyWebhook(*notifyWebhookURL, "failed", err.Error(), []string{err.Error()}, nil); err != nil {
+		logError("Failed to notify the webhook:", err)
+	}
+}
+
+// notifyWebhook posts the outcome of the run to the webhook URL
+func notifyWebhook(url, status, summary string, errors []string, report *backup.Report) error {
+	// The host tells apart the machines reporting to the same webhook
+	host, _ := os.Hostname()
+
+	payload, err := json.Marshal(notification{
+		Host:    host,
+		Status:  status,
+		Summary: summary,
+		Errors:  errors,
+		Report:  report,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: notifyTimeout}
+
+	response, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+
+	return nil
+}
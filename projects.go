@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readProjectsFile reads the project paths listed one per line in a file, or in stdin if the path is "-".
+// Blank lines and the lines starting with "#" are skipped.
+// Relative paths are resolved against the dir of the file, so that the list works regardless of the working dir.
+func readProjectsFile(path string) ([]string, error) {
+	var reader io.Reader = os.Stdin
+	baseDir := ""
+
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		reader = file
+		baseDir = filepath.Dir(path)
+	}
+
+	projectPaths := []string{}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		projectPath, err := expandHomeDir(filepath.FromSlash(line))
+		if err != nil {
+			return nil, err
+		}
+
+		if !filepath.IsAbs(projectPath) {
+			projectPath = filepath.Join(baseDir, projectPath)
+		}
+
+		projectPaths = append(projectPaths, projectPath)
+	}
+
+	return projectPaths, scanner.Err()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ni554n/git-local-backup/backup"
+)
+
+// byteSize is a flag of a human-readable size like "100MB" or "1.5 GiB"
+type byteSize int64
+
+func (size *byteSize) String() string {
+	if *size == 0 {
+		return ""
+	}
+
+	return backup.FormatSize(int64(*size))
+}
+
+func (size *byteSize) Set(value string) error {
+	bytes, err := backup.ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*size = byteSize(bytes)
+
+	return nil
+}
+
+// byteRate is a flag of a human-readable throughput like "10MB/s"
+type byteRate byteSize
+
+func (rate *byteRate) String() string {
+	if *rate == 0 {
+		return ""
+	}
+
+	return backup.FormatSize(int64(*rate)) + "/s"
+}
+
+func (rate *byteRate) Set(value string) error {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "/s"), "/S")
+
+	return (*byteSize)(rate).Set(value)
+}
+
+// formatRate formats the average throughput of copying the bytes in the duration like "1.5 MB/s"
+func formatRate(bytes int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return backup.FormatSize(0) + "/s"
+	}
+
+	return backup.FormatSize(int64(float64(bytes)/elapsed.Seconds())) + "/s"
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+)
+
+// Injected while building a release, like:
+//
+//	go build -ldflags "-X main.version=v1.1 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo identifies the running binary, for the schedulers and monitors asserting which version ran
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// currentBuildInfo returns the injected build metadata. A binary built without it, like via "go install", falls back to
+// the module version and the commit stamped by the go toolchain.
+func currentBuildInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate}
+
+	if goInfo, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "dev" && goInfo.Main.Version != "" && goInfo.Main.Version != "(devel)" {
+			info.Version = goInfo.Main.Version
+		}
+
+		for _, setting := range goInfo.Settings {
+			if setting.Key == "vcs.revision" && info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+
+	return info
+}
+
+// printVersion writes the build metadata as plain text, or as a JSON object if the format is "json"
+func printVersion(w io.Writer, format string) error {
+	info := currentBuildInfo()
+
+	if format == "json" {
+		content, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(w, string(content))
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "Git Local Backup %s\ncommit: %s\nbuilt: %s\n", info.Version, info.Commit, info.BuildDate)
+
+	return err
+}
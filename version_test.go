@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPrintVersion(t *testing.T) {
+	defer func(injectedVersion, injectedCommit, injectedBuildDate string) {
+		version, commit, buildDate = injectedVersion, injectedCommit, injectedBuildDate
+	}(version, commit, buildDate)
+
+	version, commit, buildDate = "v1.2.3", "abc123", "2024-06-01T12:00:00Z"
+
+	var output bytes.Buffer
+	if err := printVersion(&output, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var info buildInfo
+	if err := json.Unmarshal(output.Bytes(), &info); err != nil {
+		t.Fatalf("%q isn't JSON: %v", output.String(), err)
+	}
+	if want := (buildInfo{Version: version, Commit: commit, BuildDate: buildDate}); info != want {
+		t.Errorf("JSON version is %+v, want %+v", info, want)
+	}
+
+	output.Reset()
+	if err := printVersion(&output, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output.String(), "Git Local Backup v1.2.3\n") {
+		t.Errorf("text version is %q, want it to start with the version", output.String())
+	}
+}
+
+func TestCurrentBuildInfoWithoutInjectedMetadata(t *testing.T) {
+	defer func(injectedCommit, injectedBuildDate string) {
+		commit, buildDate = injectedCommit, injectedBuildDate
+	}(commit, buildDate)
+
+	commit, buildDate = "", ""
+
+	// A binary built without the ldflags still reports every field, so that a monitor can parse it
+	info := currentBuildInfo()
+	if info.Version == "" || info.Commit == "" || info.BuildDate != "unknown" {
+		t.Errorf("build info is %+v, want every field set", info)
+	}
+}